@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler serves the admin API for a DOI cache:
+//
+//	GET    /admin/cache/stats          statistics of the cache
+//	GET    /admin/cache/entry?doi=     the cached lookup of a DOI
+//	DELETE /admin/cache/entry?doi=     removes the cached lookup of a DOI
+//	DELETE /admin/cache/entries        removes all cached lookups
+func AdminHandler(cache *DoiCache) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeProblem(w, r, errorf(CodeMethodNotAllowed, nil, "method %s is not allowed", r.Method))
+			return
+		}
+
+		stats, err := cache.Stats(r.Context())
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		writeJSON(w, r, stats)
+	})
+
+	mux.HandleFunc("/admin/cache/entry", func(w http.ResponseWriter, r *http.Request) {
+		doi := r.URL.Query().Get("doi")
+		if doi == "" {
+			writeProblem(w, r, errorf(CodeBadInput, nil, "No DOI parameter provided"))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			entry, err := cache.Entry(r.Context(), doi)
+			if err != nil {
+				writeProblem(w, r, err)
+				return
+			}
+			if entry == nil {
+				writeProblem(w, r, errorf(CodeNotCached, nil, "no cached lookup of %s", doi))
+				return
+			}
+			writeJSON(w, r, entry)
+		case http.MethodDelete:
+			if err := cache.Invalidate(r.Context(), doi); err != nil {
+				writeProblem(w, r, err)
+				return
+			}
+			slog.InfoContext(r.Context(), "invalidated cached DOI lookup", "doi", doi)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeProblem(w, r, errorf(CodeMethodNotAllowed, nil, "method %s is not allowed", r.Method))
+		}
+	})
+
+	mux.HandleFunc("/admin/cache/entries", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeProblem(w, r, errorf(CodeMethodNotAllowed, nil, "method %s is not allowed", r.Method))
+			return
+		}
+
+		purged, err := cache.Purge(r.Context())
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "purged DOI cache", "purged", purged)
+		writeJSON(w, r, PurgeReport{Purged: purged})
+	})
+
+	return mux
+}
+
+// PurgeReport is the result of purging a cache
+type PurgeReport struct {
+	Purged int `json:"purged"`
+}
+
+// RequireToken only passes on requests with the given bearer token in their Authorization
+// header.  Others are rejected as unauthorized.
+func RequireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, r, errorf(CodeUnauthorized, nil, "a valid bearer token is required"))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.ErrorContext(r.Context(), "error encoding JSON response", "error", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	URL "net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AdminClient calls the admin API of a running service
+type AdminClient struct {
+	Requester
+	BaseURI string // e.g. http://localhost:8092
+	Token   string // Bearer token for the admin API
+}
+
+// Stats gets statistics of the DOI cache
+func (c AdminClient) Stats(ctx context.Context) (*CacheStats, error) {
+	var stats CacheStats
+	return &stats, c.call(ctx, http.MethodGet, "/admin/cache/stats", nil, &stats)
+}
+
+// Entry gets the cached lookup of a DOI
+func (c AdminClient) Entry(ctx context.Context, doi string) (*CacheEntryReport, error) {
+	var entry CacheEntryReport
+	return &entry, c.call(ctx, http.MethodGet, "/admin/cache/entry", URL.Values{"doi": {doi}}, &entry)
+}
+
+// Invalidate removes the cached lookup of a DOI
+func (c AdminClient) Invalidate(ctx context.Context, doi string) error {
+	return c.call(ctx, http.MethodDelete, "/admin/cache/entry", URL.Values{"doi": {doi}}, nil)
+}
+
+// Purge removes all cached lookups
+func (c AdminClient) Purge(ctx context.Context) (*PurgeReport, error) {
+	var report PurgeReport
+	return &report, c.call(ctx, http.MethodDelete, "/admin/cache/entries", nil, &report)
+}
+
+// call performs a request, and decodes its JSON response into result, if not nil.  Problem
+// responses are returned as errors with the problem's code.
+func (c AdminClient) call(ctx context.Context, method, path string, query URL.Values, result interface{}) error {
+	url := strings.TrimSuffix(c.BaseURI, "/") + path
+	if len(query) > 0 {
+		url += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "could not form admin request %s", url)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "admin request %s failed", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var problem Problem
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(body, &problem) != nil || problem.Code == "" {
+			return errors.Errorf("admin request %s failed with status %d: %s", url, resp.StatusCode, body)
+		}
+		return &Error{Code: problem.Code, Detail: problem.Detail}
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(result), "could not decode admin response from %s", url)
+}
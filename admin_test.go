@@ -0,0 +1,116 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func newAdminClient(t *testing.T, cache *pass.DoiCache) pass.AdminClient {
+	t.Helper()
+
+	server := httptest.NewServer(pass.RequireToken("secret", pass.AdminHandler(cache)))
+	t.Cleanup(server.Close)
+
+	return pass.AdminClient{Requester: server.Client(), BaseURI: server.URL, Token: "secret"}
+}
+
+func assertErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+
+	var coded pass.CodedError
+	if !errors.As(err, &coded) || coded.ErrorCode() != code {
+		t.Errorf("expected error with code %s, got %v", code, err)
+	}
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	client := newAdminClient(t, pass.NewDoiCache(pass.DoiCacheConfig{}))
+
+	for _, token := range []string{"", "wrong", "secretx"} {
+		client.Token = token
+		_, err := client.Stats(context.Background())
+		assertErrorCode(t, err, pass.CodeUnauthorized)
+	}
+}
+
+func TestAdminEntry(t *testing.T) {
+	clock := newFakeClock()
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		MaxAge:               time.Minute,
+		StaleWhileRevalidate: time.Minute,
+		Clock:                clock.Now,
+	})
+	client := newAdminClient(t, cache)
+
+	_, err := client.Entry(context.Background(), "10.1234/foo")
+	assertErrorCode(t, err, pass.CodeNotCached)
+
+	_ = didCompute(cache, "10.1234/foo")
+	_, _ = cache.GetOrAdd(context.Background(), "10.1234/missing", func(context.Context) (*pass.DoiInfo, error) {
+		return nil, &pass.Error{Code: pass.CodeDOINotFound, Detail: "not found"}
+	})
+	clock.Advance(90 * time.Second)
+
+	entry, err := client.Entry(context.Background(), "10.1234/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.State != pass.CacheStateStale || entry.AgeSeconds != 90 || entry.Info == nil || entry.Error != nil {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	entry, err = client.Entry(context.Background(), "10.1234/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.State != pass.CacheStateNotFound || entry.Error == nil || entry.Error.Code != pass.CodeDOINotFound {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
+
+func TestAdminInvalidateAndPurge(t *testing.T) {
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{})
+	client := newAdminClient(t, cache)
+
+	for _, doi := range []string{"10.1234/a", "10.1234/b", "10.1234/c"} {
+		_ = didCompute(cache, doi)
+	}
+
+	if err := client.Invalidate(context.Background(), "10.1234/a"); err != nil {
+		t.Fatal(err)
+	}
+	assertComputed(t, cache, "10.1234/a")
+	assertNotComputed(t, cache, "10.1234/b")
+
+	report, err := client.Purge(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Purged != 3 {
+		t.Errorf("expected 3 purged lookups, got %d", report.Purged)
+	}
+	assertComputed(t, cache, "10.1234/b")
+}
+
+func TestAdminStats(t *testing.T) {
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{MaxSize: 1})
+	client := newAdminClient(t, cache)
+
+	_ = didCompute(cache, "10.1234/a")
+	_ = didCompute(cache, "10.1234/a")
+	_ = didCompute(cache, "10.1234/b")
+
+	stats, err := client.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Entries != 1 || stats.Misses != 2 || stats.Evictions != 1 || stats.Hits[pass.CacheStateFound] != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditDeposit  = "deposit"  // Content was stored in Fedora
+	AuditInfected = "infected" // Content was rejected because it contains malware
+)
+
+// AuditLog records an audit trail of what content entered the repository, or was refused entry
+type AuditLog interface {
+	Record(event AuditEvent)
+}
+
+// AuditEvent is a single entry in the audit trail
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	DOI       string    `json:"doi"`
+	URL       string    `json:"url"`
+	Location  string    `json:"location,omitempty"` // URL of the stored binary, if any
+	Detail    string    `json:"detail,omitempty"`
+	RequestID string    `json:"requestId,omitempty"` // ID of the request that caused the event, if any
+	Principal string    `json:"principal,omitempty"` // Who made the request, if it was authenticated
+}
+
+// SlogAuditLog writes audit events to a structured logger, with an audit=true attribute that
+// distinguishes them from other log records
+type SlogAuditLog struct {
+	*slog.Logger
+}
+
+// Record writes an audit event to the log
+func (l SlogAuditLog) Record(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	record := slog.NewRecord(event.Time, slog.LevelInfo, "audit event", 0)
+	record.AddAttrs(
+		slog.Bool("audit", true),
+		slog.String("action", event.Action),
+		slog.String("doi", event.DOI),
+		slog.String("url", event.URL))
+
+	// Optional attributes are omitted when empty
+	for _, attr := range []slog.Attr{
+		slog.String("location", event.Location),
+		slog.String("detail", event.Detail),
+		slog.String("request_id", event.RequestID),
+		slog.String("principal", event.Principal),
+	} {
+		if attr.Value.String() != "" {
+			record.AddAttrs(attr)
+		}
+	}
+
+	logger := loggerOrDefault(l.Logger)
+	if logger.Enabled(context.Background(), slog.LevelInfo) {
+		_ = logger.Handler().Handle(context.Background(), record)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Authentication methods, recorded with each principal
+const (
+	AuthNone       = "none"       // Authentication is disabled
+	AuthShibboleth = "shibboleth" // Named in a header by a trusted proxy
+	AuthJWT        = "jwt"        // A bearer JWT signed by a key in the JWKS
+	AuthAPIKey     = "apikey"     // A static API key
+)
+
+const headerAPIKey = "X-API-Key"
+
+// jwtMethods are the JWT signing algorithms accepted
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Principal is who made a request
+type Principal struct {
+	Name   string `json:"name"`
+	Method string `json:"method"` // How they were authenticated, e.g. AuthJWT
+}
+
+// Authenticator determines who made a request.  If the request has none of the credentials it
+// accepts, it returns no principal and no error; if they are not valid, it returns an error.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authenticators authenticates requests with the first of its authenticators to find credentials
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(r *http.Request) (*Principal, error) {
+	for _, auth := range a {
+		if p, err := auth.Authenticate(r); p != nil || err != nil {
+			return p, err
+		}
+	}
+	return nil, nil
+}
+
+// Anonymous authenticates every request as made by an unnamed principal, for when authentication is disabled
+type Anonymous struct{}
+
+func (Anonymous) Authenticate(*http.Request) (*Principal, error) {
+	return &Principal{Method: AuthNone}, nil
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the given principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal carried by the context, or nil if there is none
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// RequireAuthentication refuses requests that the authenticator does not authenticate, and serves
+// those it does with their principal in the request context
+func RequireAuthentication(auth Authenticator, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := auth.Authenticate(r)
+		if err == nil && p == nil {
+			err = errors.New("no credentials were given")
+		}
+
+		if err != nil {
+			slog.WarnContext(r.Context(), "authentication failed", "remote", r.RemoteAddr, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pass-download-service"`)
+			writeProblem(w, r, errorf(CodeUnauthorized, err, "authentication is required"))
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// HeaderAuthenticator trusts the user named in a header by an authenticating proxy, such as the
+// Shibboleth service provider in front of PASS.  Since clients could set the header themselves, it
+// is only trusted in requests from the proxy's addresses.
+type HeaderAuthenticator struct {
+	Header  string
+	Proxies []netip.Prefix
+}
+
+func (a HeaderAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	name := r.Header.Get(a.Header)
+	if name == "" {
+		return nil, nil
+	}
+
+	if !a.trusted(r.RemoteAddr) {
+		return nil, fmt.Errorf("the %s header is not trusted from %s", a.Header, r.RemoteAddr)
+	}
+
+	return &Principal{Name: name, Method: AuthShibboleth}, nil
+}
+
+func (a HeaderAuthenticator) trusted(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	for _, proxy := range a.Proxies {
+		if proxy.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProxies parses a comma-separated list of addresses and CIDR ranges
+func ParseProxies(list string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, proxy := range strings.Split(list, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", proxy)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// JWTAuthenticator authenticates requests with a bearer JWT signed by one of its keys, as the
+// token's subject
+type JWTAuthenticator struct {
+	Keys     map[string]crypto.PublicKey // Keys by ID
+	Issuer   string                      // Required issuer, if not empty
+	Audience string                      // Required audience, if not empty
+}
+
+func (a JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(jwtMethods), jwt.WithExpirationRequired()}
+	if a.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.Audience))
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := jwt.ParseWithClaims(token, &claims, a.key, opts...); err != nil {
+		return nil, fmt.Errorf("invalid bearer token: %w", err)
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("invalid bearer token: it has no subject")
+	}
+
+	return &Principal{Name: claims.Subject, Method: AuthJWT}, nil
+}
+
+// key finds the key a token was signed with, by its ID.  Tokens without an ID may be signed by
+// the only key.
+func (a JWTAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	if id == "" && len(a.Keys) == 1 {
+		for _, key := range a.Keys {
+			return key, nil
+		}
+	}
+
+	key, ok := a.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// jwk is a JSON web key, with the members of RSA, EC, and OKP (Ed25519) public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS loads the signing keys of a JSON web key set file, by their IDs
+func LoadJWKS(file string) (map[string]crypto.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read JWKS: %w", err)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, fmt.Errorf("could not parse JWKS %s: %w", file, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("could not load key %q of JWKS %s: %w", k.Kid, file, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found in JWKS %s", file)
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+
+	case "OKP":
+		x, err := decode(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// APIKeyAuthenticator authenticates requests with a static API key in the X-API-Key header, as
+// the key's name
+type APIKeyAuthenticator struct {
+	keys []apiKey
+}
+
+type apiKey struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+// LoadAPIKeys loads API keys from a file with a name and key on each line, separated by
+// whitespace.  Blank lines, and lines starting with #, are ignored.
+func LoadAPIKeys(file string) (*APIKeyAuthenticator, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read API keys: %w", err)
+	}
+	defer f.Close()
+
+	auth := &APIKeyAuthenticator{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d of API keys %s is not a name and key", line, file)
+		}
+		auth.Add(fields[0], fields[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read API keys: %w", err)
+	}
+
+	return auth, nil
+}
+
+// Add adds an API key with the given name
+func (a *APIKeyAuthenticator) Add(name, key string) {
+	a.keys = append(a.keys, apiKey{name: name, hash: sha256.Sum256([]byte(key))})
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	given := r.Header.Get(headerAPIKey)
+	if given == "" {
+		return nil, nil
+	}
+
+	// Keys are compared by their hashes, in constant time, so that neither their contents nor
+	// their lengths can be found by timing
+	hash := sha256.Sum256([]byte(given))
+	var name string
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash[:]) == 1 {
+			name = key.name
+		}
+	}
+
+	if name == "" {
+		return nil, errors.New("invalid API key")
+	}
+	return &Principal{Name: name, Method: AuthAPIKey}, nil
+}
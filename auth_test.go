@@ -0,0 +1,280 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+// principalHandler responds with the name of the principal the request was made by
+var principalHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if p := pass.PrincipalFrom(r.Context()); p != nil {
+		_, _ = w.Write([]byte(p.Method + ":" + p.Name))
+	}
+})
+
+// authenticate serves a request through RequireAuthentication, returning its status and body
+func authenticate(auth pass.Authenticator, r *http.Request) (int, string) {
+	w := httptest.NewRecorder()
+	pass.RequireAuthentication(auth, principalHandler).ServeHTTP(w, r)
+	return w.Code, w.Body.String()
+}
+
+func TestRequireAuthentication(t *testing.T) {
+	keys := &pass.APIKeyAuthenticator{}
+	keys.Add("harvester", "s3cret")
+
+	proxies, err := pass.ParseProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := pass.Authenticators{pass.HeaderAuthenticator{Header: "Eppn", Proxies: proxies}, keys}
+
+	r := httptest.NewRequest(http.MethodGet, "/lookup?doi=10.1/a", nil)
+	if code, _ := authenticate(auth, r); code != http.StatusUnauthorized {
+		t.Errorf("expected a request without credentials to be unauthorized, got %d", code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/lookup?doi=10.1/a", nil)
+	r.Header.Set("X-API-Key", "s3cret")
+	if code, body := authenticate(auth, r); code != http.StatusOK || body != "apikey:harvester" {
+		t.Errorf("expected the API key to be authenticated, got %d %s", code, body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/lookup?doi=10.1/a", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("Eppn", "user@jhu.edu")
+	if code, body := authenticate(auth, r); code != http.StatusOK || body != "shibboleth:user@jhu.edu" {
+		t.Errorf("expected the header to be trusted from the proxy, got %d %s", code, body)
+	}
+
+	// Credentials that are given but not valid are refused, rather than trying other methods
+	r = httptest.NewRequest(http.MethodGet, "/lookup?doi=10.1/a", nil)
+	r.RemoteAddr = "192.168.1.1:5000"
+	r.Header.Set("Eppn", "user@jhu.edu")
+	r.Header.Set("X-API-Key", "s3cret")
+	if code, _ := authenticate(auth, r); code != http.StatusUnauthorized {
+		t.Errorf("expected the header not to be trusted from elsewhere, got %d", code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/lookup?doi=10.1/a", nil)
+	r.Header.Set("X-API-Key", "wrong")
+	w := httptest.NewRecorder()
+	pass.RequireAuthentication(auth, principalHandler).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected an invalid API key to be unauthorized with a challenge, got %d", w.Code)
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	code, body := authenticate(pass.Anonymous{}, httptest.NewRequest(http.MethodGet, "/lookup", nil))
+	if code != http.StatusOK || body != "none:" {
+		t.Errorf("expected an anonymous request to be served, got %d %s", code, body)
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	proxies, err := pass.ParseProxies(" 10.0.0.0/8, 192.168.1.1,::1 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := pass.HeaderAuthenticator{Header: "Eppn", Proxies: proxies}
+	for remote, trusted := range map[string]bool{
+		"10.20.30.40:1234":        true,
+		"192.168.1.1:1234":        true,
+		"192.168.1.2:1234":        false,
+		"[::1]:1234":              true,
+		"[::ffff:10.0.0.1]:1234":  true,
+		"[2001:db8::1]:1234":      false,
+		"not an address":          false,
+		"172.16.0.1:1234":         false,
+		"[::ffff:172.16.0.1]:123": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/lookup", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("Eppn", "user@jhu.edu")
+
+		if p, err := auth.Authenticate(r); (err == nil && p != nil) != trusted {
+			t.Errorf("expected %s to be trusted: %t, got %v, %v", remote, trusted, p, err)
+		}
+	}
+
+	if _, err := pass.ParseProxies("proxy.example.org"); err == nil {
+		t.Errorf("expected an error parsing a host name")
+	}
+}
+
+// writeJWKS writes a JSON web key set of the given keys, by ID, returning its path
+func writeJWKS(t *testing.T, keys map[string]interface{}) string {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for id, key := range keys {
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			point, err := key.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := (len(point) - 1) / 2
+			jwks.Keys = append(jwks.Keys, map[string]string{"kty": "EC", "kid": id, "use": "sig", "crv": key.Curve.Params().Name,
+				"x": encode(point[1 : 1+size]), "y": encode(point[1+size:])})
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, map[string]string{"kty": "RSA", "kid": id,
+				"n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())})
+		}
+	}
+
+	content, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, t.TempDir(), "jwks.json", content)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := pass.LoadJWKS(writeJWKS(t, map[string]interface{}{"ec": &ecKey.PublicKey, "rsa": &rsaKey.PublicKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := pass.JWTAuthenticator{Keys: keys, Issuer: "https://idp.example.org", Audience: "pass-download-service"}
+
+	claims := func(modify func(*jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		c := jwt.RegisteredClaims{
+			Subject:   "user@jhu.edu",
+			Issuer:    "https://idp.example.org",
+			Audience:  jwt.ClaimStrings{"pass-download-service"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}
+		if modify != nil {
+			modify(&c)
+		}
+		return c
+	}
+
+	sign := func(method jwt.SigningMethod, id string, key interface{}, c jwt.RegisteredClaims) string {
+		token := jwt.NewWithClaims(method, c)
+		if id != "" {
+			token.Header["kid"] = id
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"ec", sign(jwt.SigningMethodES256, "ec", ecKey, claims(nil)), true},
+		{"rsa", sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)), true},
+		{"unknown key", sign(jwt.SigningMethodES256, "other", otherKey, claims(nil)), false},
+		{"wrong key", sign(jwt.SigningMethodES256, "ec", otherKey, claims(nil)), false},
+		{"no key id", sign(jwt.SigningMethodES256, "", ecKey, claims(nil)), false},
+		{"key of another type", sign(jwt.SigningMethodHS256, "rsa", []byte("secret"), claims(nil)), false},
+		{"unsigned", sign(jwt.SigningMethodNone, "ec", jwt.UnsafeAllowNoneSignatureType, claims(nil)), false},
+		{"expired", sign(jwt.SigningMethodES256, "ec", ecKey, claims(func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		})), false},
+		{"no expiry", sign(jwt.SigningMethodES256, "ec", ecKey, claims(func(c *jwt.RegisteredClaims) { c.ExpiresAt = nil })), false},
+		{"issuer", sign(jwt.SigningMethodES256, "ec", ecKey, claims(func(c *jwt.RegisteredClaims) { c.Issuer = "https://evil.example.org" })), false},
+		{"audience", sign(jwt.SigningMethodES256, "ec", ecKey, claims(func(c *jwt.RegisteredClaims) { c.Audience = nil })), false},
+		{"no subject", sign(jwt.SigningMethodES256, "ec", ecKey, claims(func(c *jwt.RegisteredClaims) { c.Subject = "" })), false},
+		{"garbage", "not a token", false},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/lookup", nil)
+			r.Header.Set("Authorization", "Bearer "+c.token)
+
+			p, err := auth.Authenticate(r)
+			if c.valid && (err != nil || p == nil || p.Name != "user@jhu.edu" || p.Method != pass.AuthJWT) {
+				t.Errorf("expected the token to be valid, got %v, %v", p, err)
+			}
+			if !c.valid && err == nil {
+				t.Errorf("expected the token to be invalid, got %v", p)
+			}
+		})
+	}
+
+	if p, err := auth.Authenticate(httptest.NewRequest(http.MethodGet, "/lookup", nil)); p != nil || err != nil {
+		t.Errorf("expected a request without a token to have no credentials, got %v, %v", p, err)
+	}
+}
+
+func TestLoadJWKSErrors(t *testing.T) {
+	cases := map[string]string{
+		"not json":         "keys",
+		"no keys":          `{"keys": []}`,
+		"encryption only":  `{"keys": [{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`,
+		"unsupported type": `{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`,
+		"unknown curve":    `{"keys": [{"kty": "EC", "crv": "P-192", "x": "AQAB", "y": "AQAB"}]}`,
+		"off the curve":    `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQAB", "y": "AQAB"}]}`,
+		"bad modulus":      `{"keys": [{"kty": "RSA", "n": "!!", "e": "AQAB"}]}`,
+	}
+
+	for name, content := range cases {
+		content := content
+		t.Run(name, func(t *testing.T) {
+			if _, err := pass.LoadJWKS(writeFile(t, t.TempDir(), "jwks.json", []byte(content))); err == nil {
+				t.Errorf("expected an error loading %s", content)
+			}
+		})
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	auth, err := pass.LoadAPIKeys(writeFile(t, dir, "apikeys", []byte("# Harvesters\nnihms  k3y-one\n\nembargo k3y-two\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, name := range map[string]string{"k3y-one": "nihms", "k3y-two": "embargo"} {
+		r := httptest.NewRequest(http.MethodGet, "/lookup", nil)
+		r.Header.Set("X-API-Key", key)
+
+		if p, err := auth.Authenticate(r); err != nil || p.Name != name || p.Method != pass.AuthAPIKey {
+			t.Errorf("expected key %s to be authenticated as %s, got %v, %v", key, name, p, err)
+		}
+	}
+
+	if _, err := pass.LoadAPIKeys(writeFile(t, dir, "bad", []byte("nihms\n"))); err == nil {
+		t.Errorf("expected an error loading a key without a name")
+	}
+}
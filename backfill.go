@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Manifest formats
+const (
+	ManifestCSV   = "csv"
+	ManifestJSONL = "jsonl"
+)
+
+// Statuses of backfilled items
+const (
+	BackfillDeposited    = "deposited"     // A manuscript was downloaded and stored
+	BackfillNoManuscript = "no_manuscript" // The DOI has no manuscripts
+	BackfillFailed       = "failed"        // The DOI could not be looked up, or none of its manuscripts could be stored
+)
+
+const backfillDefaultConcurrency = 4
+
+// BackfillItem is a row of a backfill manifest
+type BackfillItem struct {
+	DOI        string `json:"doi"`
+	Submission string `json:"submission,omitempty"` // ID of a PASS submission, if any, carried through to the results
+}
+
+func (i BackfillItem) key() string {
+	return i.DOI + "\x00" + i.Submission
+}
+
+// BackfillResult is the outcome of backfilling an item
+type BackfillResult struct {
+	DOI        string `json:"doi"`
+	Submission string `json:"submission,omitempty"`
+	Status     string `json:"status"`
+	URL        string `json:"url,omitempty"`      // URL of the stored manuscript, or the last one tried
+	Version    string `json:"version,omitempty"`  // Version of the stored manuscript
+	Location   string `json:"location,omitempty"` // URI of the stored binary
+	Filename   string `json:"filename,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	ErrorCode  string `json:"errorCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BackfillSummary counts the outcomes of a backfill
+type BackfillSummary struct {
+	Total        int `json:"total"`
+	Skipped      int `json:"skipped"` // Already done according to the checkpoint, or repeated in the manifest
+	Deposited    int `json:"deposited"`
+	NoManuscript int `json:"noManuscript"`
+	Failed       int `json:"failed"`
+}
+
+// Backfill downloads and stores a manuscript for each of many DOIs.  For each DOI, its
+// manuscripts are tried in order of the ranking policy until one is stored.
+type Backfill struct {
+	DOIs        LookupService
+	Downloader  Downloader
+	Ranking     string // Ranking policy, e.g. RankAccepted
+	Concurrency int    // Maximum number of items backfilled at once.  If zero, a default is used
+	Log         *slog.Logger
+}
+
+// Run backfills each item that is not already done according to the checkpoint, writing its
+// result and then recording it in the checkpoint.  If the context is canceled, items in
+// progress are abandoned.  Those that still completed are recorded, so that they are not
+// deposited again when resumed, but failures are not, since they may be due to the cancellation.
+func (b *Backfill) Run(ctx context.Context, items []BackfillItem, checkpoint *BackfillCheckpoint, results BackfillWriter) (BackfillSummary, error) {
+	summary := BackfillSummary{Total: len(items)}
+
+	if _, err := RankManuscriptsBy(b.Ranking, nil); err != nil {
+		return summary, err
+	}
+
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = backfillDefaultConcurrency
+	}
+
+	var pending []BackfillItem
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if checkpoint.Done(item) || seen[item.key()] {
+			summary.Skipped++
+			continue
+		}
+		seen[item.key()] = true
+		pending = append(pending, item)
+	}
+
+	// Stop backfilling if results cannot be recorded
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan BackfillItem)
+	done := make(chan BackfillResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				result := b.backfill(ctx, item)
+				if result.Status != BackfillFailed || ctx.Err() == nil {
+					done <- result
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, item := range pending {
+			select {
+			case jobs <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	for result := range done {
+		if err != nil {
+			continue // Drain the remaining results, so that the workers finish
+		}
+
+		if err = results.Write(result); err == nil {
+			err = checkpoint.Record(BackfillItem{DOI: result.DOI, Submission: result.Submission})
+		}
+		if err != nil {
+			cancel()
+			continue
+		}
+
+		switch result.Status {
+		case BackfillDeposited:
+			summary.Deposited++
+		case BackfillNoManuscript:
+			summary.NoManuscript++
+		default:
+			summary.Failed++
+		}
+	}
+
+	if err != nil {
+		return summary, err
+	}
+	return summary, parent.Err()
+}
+
+// backfill looks up an item's manuscripts, and tries each in turn until one is stored
+func (b *Backfill) backfill(ctx context.Context, item BackfillItem) BackfillResult {
+	result := BackfillResult{DOI: item.DOI, Submission: item.Submission, Status: BackfillFailed}
+
+	info, err := b.DOIs.Lookup(ctx, item.DOI)
+	if err != nil {
+		return result.failed(err)
+	}
+
+	manuscripts, _ := RankManuscriptsBy(b.Ranking, info.Manuscripts)
+	if len(manuscripts) == 0 {
+		result.Status = BackfillNoManuscript
+		return result
+	}
+
+	for _, manuscript := range manuscripts {
+		result.URL = manuscript.Location
+
+		download, err := b.Downloader.Download(ctx, item.DOI, manuscript.Location)
+		if err == nil {
+			result.Status = BackfillDeposited
+			result.Version = manuscript.Version
+			result.Location, result.Filename, result.SHA256 = download.Location, download.Filename, download.SHA256
+			result.ErrorCode, result.Error = "", ""
+			return result
+		}
+
+		result = result.failed(err)
+		loggerOrDefault(b.Log).WarnContext(ctx, "could not backfill manuscript", "doi", item.DOI,
+			"url", RedactURL(manuscript.Location), "error", err)
+
+		// Other manuscripts will not fare any better if the store is failing
+		if result.ErrorCode == CodeStoreFailed || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return result
+}
+
+func (r BackfillResult) failed(err error) BackfillResult {
+	report := reportError(err)
+	r.Status, r.ErrorCode, r.Error = BackfillFailed, report.Code, report.Detail
+	return r
+}
+
+// ReadBackfillManifest reads the items of a manifest.  A CSV manifest has a header row naming
+// its doi column, and optionally its submission column.  A JSONL manifest has a BackfillItem
+// on each line.  DOI URLs are reduced to their DOIs, and rows without a DOI are ignored.
+func ReadBackfillManifest(r io.Reader, format string) ([]BackfillItem, error) {
+	var items []BackfillItem
+	add := func(item BackfillItem) {
+		if item.DOI = trimDOI(strings.TrimSpace(item.DOI)); item.DOI != "" {
+			item.Submission = strings.TrimSpace(item.Submission)
+			items = append(items, item)
+		}
+	}
+
+	switch format {
+	case ManifestCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("could not read manifest header: %w", err)
+		}
+
+		columns := make(map[string]int)
+		for i, name := range header {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		if _, ok := columns["doi"]; !ok {
+			return nil, fmt.Errorf("manifest has no doi column")
+		}
+
+		field := func(record []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return items, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not read manifest: %w", err)
+			}
+			add(BackfillItem{DOI: field(record, "doi"), Submission: field(record, "submission")})
+		}
+
+	case ManifestJSONL:
+		scanner := bufio.NewScanner(r)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+
+			var item BackfillItem
+			if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+				return nil, fmt.Errorf("could not read manifest line %d: %w", line, err)
+			}
+			add(item)
+		}
+		return items, scanner.Err()
+
+	default:
+		return nil, fmt.Errorf("unknown manifest format %q, expected csv or jsonl", format)
+	}
+}
+
+// manifestFormat determines the format of a manifest from its file name
+func manifestFormat(path string) string {
+	for _, ext := range []string{".jsonl", ".ndjson", ".json"} {
+		if strings.HasSuffix(strings.ToLower(path), ext) {
+			return ManifestJSONL
+		}
+	}
+	return ManifestCSV
+}
+
+// BackfillWriter writes backfill results in some format.  Each result is written through
+// as soon as it is written, so that none are lost if the backfill is interrupted.
+type BackfillWriter interface {
+	Write(result BackfillResult) error
+}
+
+// NewBackfillWriter creates a writer for the given manifest format.  If header is true, a CSV
+// header row is written first.
+func NewBackfillWriter(w io.Writer, format string, header bool) (BackfillWriter, error) {
+	switch format {
+	case ManifestCSV:
+		out := &csvBackfillWriter{w: csv.NewWriter(w)}
+		if header {
+			_ = out.w.Write([]string{"doi", "submission", "status", "url", "version", "location", "filename", "sha256", "errorCode", "error"})
+			out.w.Flush()
+		}
+		return out, out.w.Error()
+	case ManifestJSONL:
+		return jsonlBackfillWriter{json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown manifest format %q, expected csv or jsonl", format)
+	}
+}
+
+type csvBackfillWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvBackfillWriter) Write(r BackfillResult) error {
+	_ = c.w.Write([]string{r.DOI, r.Submission, r.Status, r.URL, r.Version, r.Location, r.Filename, r.SHA256, r.ErrorCode, r.Error})
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlBackfillWriter struct {
+	encoder *json.Encoder
+}
+
+func (j jsonlBackfillWriter) Write(r BackfillResult) error {
+	return j.encoder.Encode(r)
+}
+
+// BackfillCheckpoint records which items of a backfill are done, in a file with an item on
+// each line, so that an interrupted backfill can be resumed.
+type BackfillCheckpoint struct {
+	file *os.File
+	done map[string]bool
+}
+
+// OpenBackfillCheckpoint opens (or creates) a checkpoint file, and reads the items already done
+func OpenBackfillCheckpoint(path string) (*BackfillCheckpoint, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open checkpoint: %w", err)
+	}
+
+	checkpoint := &BackfillCheckpoint{file: file, done: make(map[string]bool)}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var item BackfillItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			// A line cut short by a crash; the item will be backfilled again
+			continue
+		}
+		checkpoint.done[item.key()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not read checkpoint %s: %w", path, err)
+	}
+
+	if err := endLine(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not write checkpoint %s: %w", path, err)
+	}
+
+	return checkpoint, nil
+}
+
+// endLine ends a line cut short at the end of a file, so that what is appended starts on a line
+// of its own
+func endLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err = file.ReadAt(last, info.Size()-1); err != nil || last[0] == '\n' {
+		return err
+	}
+
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
+
+// Done is whether an item is done
+func (c *BackfillCheckpoint) Done(item BackfillItem) bool {
+	return c.done[item.key()]
+}
+
+// Record records that an item is done, and syncs the file so that the record survives a crash
+func (c *BackfillCheckpoint) Record(item BackfillItem) error {
+	line, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	c.done[item.key()] = true
+
+	return c.file.Sync()
+}
+
+// Close closes the checkpoint file
+func (c *BackfillCheckpoint) Close() error {
+	return c.file.Close()
+}
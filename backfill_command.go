@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// backfillCommand downloads and stores manuscripts for each DOI in a manifest
+func backfillCommand() *cli.Command {
+	var opts serveOpts
+	var manifest, format, results, checkpoint, ranking, out string
+	var concurrency int
+	var politeness time.Duration
+
+	return withConfigFile(&cli.Command{
+		Name:  "backfill",
+		Usage: "Download and store a manuscript for each DOI in a manifest, recording the results in another",
+		Flags: concatFlags([]cli.Flag{
+			&cli.StringFlag{
+				Name:        "manifest",
+				Usage:       "CSV (with doi and optional submission columns) or JSONL manifest of DOIs",
+				Destination: &manifest,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "Format of the manifest and results: csv or jsonl.  If empty, it is determined by the manifest's extension",
+				Destination: &format,
+			},
+			&cli.StringFlag{
+				Name:        "results",
+				Usage:       "File the results are appended to",
+				Destination: &results,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "checkpoint",
+				Usage:       "File recording which DOIs are done, for resuming an interrupted backfill (default: the results file with .checkpoint appended)",
+				Destination: &checkpoint,
+			},
+			&cli.StringFlag{
+				Name:        "rank",
+				Usage:       "Policy for ranking the manuscripts of a DOI: accepted, published, or as-found",
+				Destination: &ranking,
+				Value:       RankAccepted,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Usage:       "Maximum number of DOIs backfilled at once",
+				Destination: &concurrency,
+				Value:       backfillDefaultConcurrency,
+			},
+			&cli.DurationFlag{
+				Name:        "politeness",
+				Usage:       "Minimum time between downloads from any one host",
+				Destination: &politeness,
+				Value:       1 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:        "out",
+				Aliases:     []string{"o"},
+				Usage:       "Directory to store manuscripts in, instead of Fedora",
+				Destination: &out,
+			},
+		}, unpaywallFlags(&opts), outboundFlags(&opts), fedoraFlags(&opts), downloadFlags(&opts), logFlags(&opts)),
+		Action: func(c *cli.Context) error {
+			if err := opts.validate(downloadChecks(out)...); err != nil {
+				return err
+			}
+
+			logger, err := NewLogger(c.App.ErrWriter, opts.logLevel, opts.logFormat)
+			if err != nil {
+				return err
+			}
+
+			if format == "" {
+				format = manifestFormat(manifest)
+			}
+			if checkpoint == "" {
+				checkpoint = results + ".checkpoint"
+			}
+
+			items, err := readManifestFile(manifest, format)
+			if err != nil {
+				return err
+			}
+
+			cp, err := OpenBackfillCheckpoint(checkpoint)
+			if err != nil {
+				return err
+			}
+			defer cp.Close()
+
+			resultsFile, err := os.OpenFile(results, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("could not open results: %w", err)
+			}
+			defer resultsFile.Close()
+
+			stat, err := resultsFile.Stat()
+			if err != nil {
+				return err
+			}
+			writer, err := NewBackfillWriter(resultsFile, format, stat.Size() == 0)
+			if err != nil {
+				return err
+			}
+
+			rootCAs, err := opts.rootCAs()
+			if err != nil {
+				return err
+			}
+
+			requester := LogRequests(logger, newHTTPClient(opts.maxredirects, rootCAs))
+
+			// Each DOI is looked up to rank its manuscripts, then again to verify the one downloaded
+			unpaywall := UnpaywallService{
+				HTTP:    requester,
+				Baseuri: opts.unpaywallBaseURI,
+				Email:   opts.unpaywallEmail,
+				Cache:   NewDoiCache(DoiCacheConfig{MaxSize: 10 * max(concurrency, 1), MaxAge: time.Hour, Log: logger}),
+				Log:     logger,
+			}
+
+			var store BinaryStore = LocalFileStore{}
+			if out != "" {
+				opts.downloadDest = out
+			} else {
+				if opts.downloadDest == "" {
+					return fmt.Errorf("either --download.dest or --out must be given")
+				}
+				_, store = opts.fedora(PropagateTrace(LogRequests(logger, newHTTPClient(opts.maxredirects, rootCAs))), logger)
+			}
+
+			backfill := &Backfill{
+				DOIs:        unpaywall,
+				Downloader:  opts.downloadService(&HostThrottle{Requester: requester, Interval: politeness}, unpaywall, store, logger),
+				Ranking:     ranking,
+				Concurrency: concurrency,
+				Log:         logger,
+			}
+
+			ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			summary, err := backfill.Run(ctx, items, cp, writer)
+
+			encoder := json.NewEncoder(c.App.Writer)
+			encoder.SetIndent("", "  ")
+			_ = encoder.Encode(summary)
+
+			if err == context.Canceled {
+				return fmt.Errorf("backfill interrupted; run it again to resume")
+			}
+			return err
+		},
+	})
+}
+
+func readManifestFile(path, format string) ([]BackfillItem, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open manifest: %w", err)
+	}
+	defer file.Close()
+
+	items, err := ReadBackfillManifest(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest %s: %w", path, err)
+	}
+	return items, nil
+}
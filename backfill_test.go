@@ -0,0 +1,277 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-test/deep"
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func TestReadBackfillManifest(t *testing.T) {
+	expected := []pass.BackfillItem{
+		{DOI: "10.1234/a", Submission: "sub1"},
+		{DOI: "10.1234/b"},
+	}
+
+	csvItems, err := pass.ReadBackfillManifest(strings.NewReader(`Submission,DOI,title
+sub1,https://doi.org/10.1234/a,A
+,10.1234/b,B
+sub3,,No DOI
+`), pass.ManifestCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := deep.Equal(csvItems, expected); len(diffs) > 0 {
+		t.Errorf("unexpected CSV items: %v", diffs)
+	}
+
+	jsonlItems, err := pass.ReadBackfillManifest(strings.NewReader(`{"doi": "10.1234/a", "submission": "sub1"}
+
+{"doi": "doi:10.1234/b"}
+`), pass.ManifestJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := deep.Equal(jsonlItems, expected); len(diffs) > 0 {
+		t.Errorf("unexpected JSONL items: %v", diffs)
+	}
+
+	if _, err = pass.ReadBackfillManifest(strings.NewReader("submission\nsub1\n"), pass.ManifestCSV); err == nil {
+		t.Errorf("expected error for manifest without a doi column")
+	}
+}
+
+// fakeDownloader downloads URLs that end in .pdf, and records what it downloaded
+type fakeDownloader struct {
+	m          sync.Mutex
+	downloaded []string
+}
+
+func (f *fakeDownloader) Download(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+	if !strings.HasSuffix(url, ".pdf") {
+		return nil, &pass.Error{Code: pass.CodeNotAPDF, Detail: "not a PDF"}
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.downloaded = append(f.downloaded, url)
+
+	return &pass.DownloadResult{Location: "http://fedora/" + doi, Filename: "file.pdf", SHA256: "abc123"}, nil
+}
+
+func TestBackfill(t *testing.T) {
+	lookups := mapLookup{
+		"10.1234/a": {Manuscripts: []pass.Manuscript{
+			{Location: "http://example.org/a-published.pdf", Version: "publishedVersion"},
+			{Location: "http://example.org/a-accepted.html", Version: "acceptedVersion"},
+		}},
+		"10.1234/none": {},
+	}
+	items := []pass.BackfillItem{
+		{DOI: "10.1234/a", Submission: "sub1"},
+		{DOI: "10.1234/none"},
+		{DOI: "10.1234/missing"},
+		{DOI: "10.1234/a", Submission: "sub1"}, // repeated
+	}
+
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint")
+	checkpoint, err := pass.OpenBackfillCheckpoint(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results bytes.Buffer
+	writer, _ := pass.NewBackfillWriter(&results, pass.ManifestJSONL, false)
+	downloader := &fakeDownloader{}
+
+	backfill := &pass.Backfill{DOIs: lookups, Downloader: downloader, Ranking: pass.RankAccepted, Concurrency: 2}
+	summary, err := backfill.Run(context.Background(), items, checkpoint, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.Close()
+
+	if diffs := deep.Equal(summary, pass.BackfillSummary{Total: 4, Skipped: 1, Deposited: 1, NoManuscript: 1, Failed: 1}); len(diffs) > 0 {
+		t.Errorf("unexpected summary: %v", diffs)
+	}
+
+	got := make(map[string]pass.BackfillResult)
+	for _, line := range strings.Split(strings.TrimSpace(results.String()), "\n") {
+		var result pass.BackfillResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatal(err)
+		}
+		got[result.DOI] = result
+	}
+
+	// The accepted version is ranked first, but is not a PDF, so the published version is stored
+	expected := map[string]pass.BackfillResult{
+		"10.1234/a": {DOI: "10.1234/a", Submission: "sub1", Status: pass.BackfillDeposited, URL: "http://example.org/a-published.pdf",
+			Version: "publishedVersion", Location: "http://fedora/10.1234/a", Filename: "file.pdf", SHA256: "abc123"},
+		"10.1234/none":    {DOI: "10.1234/none", Status: pass.BackfillNoManuscript},
+		"10.1234/missing": {DOI: "10.1234/missing", Status: pass.BackfillFailed, ErrorCode: pass.CodeDOINotFound, Error: "DOI not found"},
+	}
+	if diffs := deep.Equal(got, expected); len(diffs) > 0 {
+		t.Errorf("unexpected results: %v", diffs)
+	}
+
+	// Resuming skips everything that is done
+	checkpoint, err = pass.OpenBackfillCheckpoint(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+
+	items = append(items, pass.BackfillItem{DOI: "10.1234/a", Submission: "sub2"})
+	summary, err = backfill.Run(context.Background(), items, checkpoint, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Skipped != 4 || summary.Deposited != 1 {
+		t.Errorf("expected only the new item to be backfilled, got %+v", summary)
+	}
+	if len(downloader.downloaded) != 2 {
+		t.Errorf("expected 2 downloads in total, got %v", downloader.downloaded)
+	}
+}
+
+func TestBackfillCanceled(t *testing.T) {
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint")
+	checkpoint, _ := pass.OpenBackfillCheckpoint(checkpointPath)
+	defer checkpoint.Close()
+
+	var items []pass.BackfillItem
+	for i := 0; i < 10; i++ {
+		items = append(items, pass.BackfillItem{DOI: fmt.Sprintf("10.1234/%d", i)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var results bytes.Buffer
+	writer, _ := pass.NewBackfillWriter(&results, pass.ManifestCSV, true)
+	backfill := &pass.Backfill{DOIs: mapLookup{}, Downloader: &fakeDownloader{}, Ranking: pass.RankAccepted}
+
+	if _, err := backfill.Run(ctx, items, checkpoint, writer); err != context.Canceled {
+		t.Errorf("expected canceled backfill, got %v", err)
+	}
+
+	if strings.TrimSpace(results.String()) != "doi,submission,status,url,version,location,filename,sha256,errorCode,error" {
+		t.Errorf("expected no results from a canceled backfill, got %s", results.String())
+	}
+}
+
+func TestBackfillCompletedWhenCanceled(t *testing.T) {
+	checkpoint, _ := pass.OpenBackfillCheckpoint(filepath.Join(t.TempDir(), "checkpoint"))
+	defer checkpoint.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Interrupted while the manuscript is deposited, which completes anyway
+	item := pass.BackfillItem{DOI: "10.1234/a"}
+	lookups := mapLookup{"10.1234/a": {Manuscripts: []pass.Manuscript{{Location: "http://example.org/a.pdf"}}}}
+	downloader := MockDownloader(func(doi, url string) (*pass.DownloadResult, error) {
+		cancel()
+		return &pass.DownloadResult{Location: "http://fedora/10.1234/a"}, nil
+	})
+
+	var results bytes.Buffer
+	writer, _ := pass.NewBackfillWriter(&results, pass.ManifestJSONL, false)
+	backfill := &pass.Backfill{DOIs: lookups, Downloader: downloader, Ranking: pass.RankAccepted}
+
+	summary, err := backfill.Run(ctx, []pass.BackfillItem{item}, checkpoint, writer)
+	if err != context.Canceled {
+		t.Errorf("expected canceled backfill, got %v", err)
+	}
+
+	if summary.Deposited != 1 || !strings.Contains(results.String(), "http://fedora/10.1234/a") {
+		t.Errorf("expected the deposit to be written, got %+v, %s", summary, results.String())
+	}
+	if !checkpoint.Done(item) {
+		t.Errorf("expected the deposit to be recorded, so that it is not deposited again")
+	}
+}
+
+func TestBackfillEscapedLocation(t *testing.T) {
+	checkpoint, _ := pass.OpenBackfillCheckpoint(filepath.Join(t.TempDir(), "checkpoint"))
+	defer checkpoint.Close()
+
+	location := "http://example.org/a%20b.pdf"
+	lookups := mapLookup{"10.1234/a": {Manuscripts: []pass.Manuscript{{Location: location}}}}
+
+	downloader := pass.DownloadService{
+		Dest: "http://fcrepo:8080/fcrepo/rest/bin/",
+		DOIs: lookups,
+		HTTP: MockRequester(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader("%PDF-1.4 manuscript")),
+				Header:     http.Header{"Content-Type": {"application/pdf"}},
+			}, nil
+		}),
+		Fedora: MockBinaryStore(func(string, io.Reader, string, pass.BinaryMetadata) (string, error) {
+			return "http://fcrepo:8080/fcrepo/rest/bin/a", nil
+		}),
+	}
+
+	var results bytes.Buffer
+	writer, _ := pass.NewBackfillWriter(&results, pass.ManifestJSONL, false)
+	backfill := &pass.Backfill{DOIs: lookups, Downloader: downloader, Ranking: pass.RankAccepted}
+
+	summary, err := backfill.Run(context.Background(), []pass.BackfillItem{{DOI: "10.1234/a"}}, checkpoint, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Deposited != 1 {
+		t.Errorf("expected the manuscript at %s to be deposited, got %s", location, results.String())
+	}
+}
+
+func TestBackfillRanking(t *testing.T) {
+	backfill := &pass.Backfill{Ranking: "newest"}
+	if _, err := backfill.Run(context.Background(), nil, nil, nil); err == nil {
+		t.Errorf("expected error for unknown ranking policy")
+	}
+}
+
+func TestBackfillCheckpointCutShort(t *testing.T) {
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint")
+
+	// A crash while recording 10.1234/b
+	content := `{"doi":"10.1234/a"}` + "\n" + `{"doi":"10.12`
+	if err := os.WriteFile(checkpointPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := pass.OpenBackfillCheckpoint(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.Record(pass.BackfillItem{DOI: "10.1234/b"}); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.Close()
+
+	checkpoint, err = pass.OpenBackfillCheckpoint(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+
+	for _, doi := range []string{"10.1234/a", "10.1234/b"} {
+		if !checkpoint.Done(pass.BackfillItem{DOI: doi}) {
+			t.Errorf("expected %s to be done", doi)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltLookupsBucket = []byte("lookups") // DOI -> lookup
+	boltExpiryBucket  = []byte("expiry")  // Expiry time + DOI -> DOI, in order of expiry
+)
+
+// BoltCacheStore stores a limited number of lookups in a BoltDB file, so that they survive
+// restarts.  When it is full, the lookups closest to expiring are evicted, however recently
+// they were read; keeping lookups in order of use too would make every read a write.  Only one
+// process may use the file at a time.
+type BoltCacheStore struct {
+	db      *bolt.DB
+	maxSize int
+	m       sync.Mutex // Held while writing, so that size is kept in step with the file
+	size    int
+}
+
+// OpenBoltCacheStore opens (or creates) a store in the given file, holding at most maxSize lookups
+func OpenBoltCacheStore(path string, maxSize int) (*BoltCacheStore, error) {
+	if maxSize <= 0 {
+		maxSize = CacheDefaultSize
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open cache file %s", path)
+	}
+
+	store := &BoltCacheStore{db: db, maxSize: maxSize}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		lookups, err := tx.CreateBucketIfNotExists(boltLookupsBucket)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.CreateBucketIfNotExists(boltExpiryBucket); err != nil {
+			return err
+		}
+
+		store.size = lookups.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "could not initialize cache file %s", path)
+	}
+
+	return store, nil
+}
+
+// Close closes the underlying file
+func (s *BoltCacheStore) Close() error {
+	return s.db.Close()
+}
+
+// Get implements CacheStore
+func (s *BoltCacheStore) Get(_ context.Context, doi string) (*CachedLookup, error) {
+	var lookup *CachedLookup
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lookup, err = s.get(tx, doi)
+		return err
+	})
+
+	return lookup, err
+}
+
+// Put implements CacheStore
+func (s *BoltCacheStore) Put(_ context.Context, doi string, lookup *CachedLookup, _ time.Time) (int, error) {
+	value, err := serializeLookup(lookup)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not serialize lookup of %s", doi)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	size, evicted := s.size, 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		size, evicted = s.size, 0
+
+		removed, err := s.remove(tx, doi)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			size++
+		}
+
+		if err = tx.Bucket(boltLookupsBucket).Put([]byte(doi), value); err != nil {
+			return err
+		}
+		if err = tx.Bucket(boltExpiryBucket).Put(boltExpiryKey(lookup.Expires, doi), []byte(doi)); err != nil {
+			return err
+		}
+
+		// Evict the lookups closest to expiring, other than the one just added
+		var victims [][]byte
+		cursor := tx.Bucket(boltExpiryBucket).Cursor()
+		for k, v := cursor.First(); k != nil && size-len(victims) > s.maxSize; k, v = cursor.Next() {
+			if string(v) != doi {
+				victims = append(victims, append([]byte(nil), v...))
+			}
+		}
+
+		for _, victim := range victims {
+			if _, err := s.remove(tx, string(victim)); err != nil {
+				return err
+			}
+		}
+		size -= len(victims)
+		evicted = len(victims)
+
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not store lookup of %s", doi)
+	}
+
+	s.size = size
+	return evicted, nil
+}
+
+// Remove implements CacheStore
+func (s *BoltCacheStore) Remove(_ context.Context, doi string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	removed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		removed, err = s.remove(tx, doi)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not remove lookup of %s", doi)
+	}
+
+	if removed {
+		s.size--
+	}
+	return nil
+}
+
+// Expire implements CacheStore
+func (s *BoltCacheStore) Expire(_ context.Context, now time.Time) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	expired := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var dois [][]byte
+		limit := boltExpiryKey(now, "")
+
+		cursor := tx.Bucket(boltExpiryBucket).Cursor()
+		for k, v := cursor.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, v = cursor.Next() {
+			dois = append(dois, append([]byte(nil), v...))
+		}
+
+		for _, doi := range dois {
+			if _, err := s.remove(tx, string(doi)); err != nil {
+				return err
+			}
+		}
+
+		expired = len(dois)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not expire lookups")
+	}
+
+	s.size -= expired
+	return expired, nil
+}
+
+// Len implements CacheStore
+func (s *BoltCacheStore) Len(context.Context) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.size, nil
+}
+
+// Purge implements CacheStore
+func (s *BoltCacheStore) Purge(context.Context) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltLookupsBucket, boltExpiryBucket} {
+			if err := tx.DeleteBucket(bucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not purge lookups")
+	}
+
+	purged := s.size
+	s.size = 0
+	return purged, nil
+}
+
+func (s *BoltCacheStore) get(tx *bolt.Tx, doi string) (*CachedLookup, error) {
+	value := tx.Bucket(boltLookupsBucket).Get([]byte(doi))
+	if value == nil {
+		return nil, nil
+	}
+
+	lookup, err := deserializeLookup(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not deserialize lookup of %s", doi)
+	}
+
+	return lookup, nil
+}
+
+// remove removes a lookup and its expiry, if there is one.  A lookup that cannot be deserialized
+// (e.g. one stored by an incompatible version) is removed too, so that it can be replaced.
+func (s *BoltCacheStore) remove(tx *bolt.Tx, doi string) (bool, error) {
+	value := tx.Bucket(boltLookupsBucket).Get([]byte(doi))
+	if value == nil {
+		return false, nil
+	}
+
+	if stored, err := deserializeLookup(value); err == nil {
+		err = tx.Bucket(boltExpiryBucket).Delete(boltExpiryKey(stored.Expires, doi))
+		if err != nil {
+			return false, err
+		}
+	} else if err = removeExpiries(tx, doi); err != nil {
+		return false, err
+	}
+
+	return true, tx.Bucket(boltLookupsBucket).Delete([]byte(doi))
+}
+
+// removeExpiries removes every expiry of a DOI, for when its lookup cannot be read to find it.
+// This scans all the expiries, which is slow for a large file, but is only needed once for each
+// lookup that cannot be read, e.g. after upgrading from an incompatible version.
+func removeExpiries(tx *bolt.Tx, doi string) error {
+	var keys [][]byte
+	cursor := tx.Bucket(boltExpiryBucket).Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if string(v) == doi {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+	}
+
+	for _, key := range keys {
+		if err := tx.Bucket(boltExpiryBucket).Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltExpiryKey orders lookups by expiry time, then DOI
+func boltExpiryKey(expires time.Time, doi string) []byte {
+	key := make([]byte, 8, 8+len(doi))
+	binary.BigEndian.PutUint64(key, uint64(expires.UnixNano()))
+	return append(key, doi...)
+}
@@ -0,0 +1,213 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	pass "github.com/oa-pass/pass-download-service"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltCacheStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	clock := newFakeClock()
+
+	info := &pass.DoiInfo{Manuscripts: []pass.Manuscript{{Location: "http://example.org/file.pdf", Name: "file.pdf"}}}
+	notFound := &pass.Error{Code: pass.CodeDOINotFound, Detail: "not found"}
+
+	store, err := pass.OpenBoltCacheStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{MaxAge: time.Minute, NotFoundAge: time.Hour, Store: store, Clock: clock.Now})
+	_, _ = cache.GetOrAdd(context.Background(), "found", func(context.Context) (*pass.DoiInfo, error) { return info, nil })
+	_, _ = cache.GetOrAdd(context.Background(), "notFound", func(context.Context) (*pass.DoiInfo, error) { return nil, notFound })
+
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new cache, as if after a restart
+	store, err = pass.OpenBoltCacheStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	cache = pass.NewDoiCache(pass.DoiCacheConfig{MaxAge: time.Minute, NotFoundAge: time.Hour, Store: store, Clock: clock.Now})
+
+	cached, err := cache.GetOrAdd(context.Background(), "found", func(context.Context) (*pass.DoiInfo, error) {
+		t.Fatal("lookup should have been cached")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := deep.Equal(info, cached); len(diffs) > 0 {
+		t.Errorf("cached lookup differed from the original: %v", diffs)
+	}
+
+	_, err = cache.GetOrAdd(context.Background(), "notFound", func(context.Context) (*pass.DoiInfo, error) {
+		t.Fatal("not found lookup should have been cached")
+		return nil, nil
+	})
+	var coded pass.CodedError
+	if !errors.As(err, &coded) || coded.ErrorCode() != pass.CodeDOINotFound || err.Error() != notFound.Error() {
+		t.Errorf("expected cached not found error, got %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	assertComputed(t, cache, "found")
+	assertNotComputed(t, cache, "notFound")
+}
+
+func TestBoltCacheStoreSize(t *testing.T) {
+	store, err := pass.OpenBoltCacheStore(filepath.Join(t.TempDir(), "cache.db"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	for i, doi := range []string{"second", "first", "third"} {
+		evicted, err := store.Put(context.Background(), doi, &pass.CachedLookup{Info: &pass.DoiInfo{}, Expires: now.Add(time.Duration(i) * time.Minute)}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i < 2 && evicted != 0 || i == 2 && evicted != 1 {
+			t.Errorf("unexpected evictions %d after storing %s", evicted, doi)
+		}
+	}
+
+	// The lookup closest to expiry is evicted
+	for doi, present := range map[string]bool{"second": false, "first": true, "third": true} {
+		lookup, err := store.Get(context.Background(), doi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (lookup != nil) != present {
+			t.Errorf("expected %s present: %t", doi, present)
+		}
+	}
+}
+
+func TestBoltCacheStoreExpire(t *testing.T) {
+	store, err := pass.OpenBoltCacheStore(filepath.Join(t.TempDir(), "cache.db"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	_, _ = store.Put(context.Background(), "old", &pass.CachedLookup{Expires: now.Add(-time.Second)}, time.Now())
+	_, _ = store.Put(context.Background(), "current", &pass.CachedLookup{Expires: now}, time.Now())
+	_, _ = store.Put(context.Background(), "new", &pass.CachedLookup{Expires: now.Add(time.Second)}, time.Now())
+	_, _ = store.Put(context.Background(), "old", &pass.CachedLookup{Expires: now.Add(-time.Minute)}, time.Now()) // replaced
+
+	expired, err := store.Expire(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 2 {
+		t.Errorf("expected 2 expired lookups, got %d", expired)
+	}
+
+	if lookup, _ := store.Get(context.Background(), "new"); lookup == nil {
+		t.Errorf("unexpired lookup was removed")
+	}
+}
+
+func TestBoltCacheStorePurge(t *testing.T) {
+	store, err := pass.OpenBoltCacheStore(filepath.Join(t.TempDir(), "cache.db"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for _, doi := range []string{"a", "b"} {
+		_, _ = store.Put(context.Background(), doi, &pass.CachedLookup{Expires: time.Now().Add(time.Minute)}, time.Now())
+	}
+
+	if n, _ := store.Len(context.Background()); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+
+	purged, err := store.Purge(context.Background())
+	if err != nil || purged != 2 {
+		t.Fatalf("expected 2 purged lookups, got %d, %v", purged, err)
+	}
+
+	if n, _ := store.Len(context.Background()); n != 0 {
+		t.Errorf("expected no lookups, got %d", n)
+	}
+	if lookup, _ := store.Get(context.Background(), "a"); lookup != nil {
+		t.Errorf("purged lookup is still present")
+	}
+}
+
+func TestBoltCacheStoreCorruptLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	now := time.Now()
+
+	store, err := pass.OpenBoltCacheStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = store.Put(context.Background(), "10.1/a", &pass.CachedLookup{Expires: now.Add(time.Minute)}, time.Now())
+	_, _ = store.Put(context.Background(), "10.1/b", &pass.CachedLookup{Expires: now.Add(time.Minute)}, time.Now())
+	store.Close()
+
+	// e.g. written by an incompatible version
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, doi := range []string{"10.1/a", "10.1/b"} {
+			if err := tx.Bucket([]byte("lookups")).Put([]byte(doi), []byte("garbage")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = pass.OpenBoltCacheStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.Get(context.Background(), "10.1/a"); err == nil {
+		t.Errorf("expected an error reading a corrupt lookup")
+	}
+
+	if _, err := store.Put(context.Background(), "10.1/a", &pass.CachedLookup{Expires: now.Add(time.Hour)}, time.Now()); err != nil {
+		t.Fatalf("expected a corrupt lookup to be replaced, got %v", err)
+	}
+	if lookup, err := store.Get(context.Background(), "10.1/a"); err != nil || lookup == nil {
+		t.Errorf("expected the replaced lookup, got %v, %v", lookup, err)
+	}
+
+	if err := store.Remove(context.Background(), "10.1/b"); err != nil {
+		t.Errorf("expected a corrupt lookup to be removed, got %v", err)
+	}
+
+	if size, _ := store.Len(context.Background()); size != 1 {
+		t.Errorf("expected 1 lookup, got %d", size)
+	}
+
+	// The expiries of the corrupt lookups were removed with them
+	if expired, err := store.Expire(context.Background(), now.Add(30*time.Minute)); err != nil || expired != 0 {
+		t.Errorf("expected no lookups to expire, got %d, %v", expired, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// cacheCommand administers the DOI cache of a running service, via its admin API
+func cacheCommand() *cli.Command {
+	var client AdminClient
+
+	doiArg := func(c *cli.Context) (string, error) {
+		if c.NArg() != 1 {
+			return "", fmt.Errorf("expected a single DOI argument")
+		}
+		return c.Args().First(), nil
+	}
+
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "Administer the DOI cache of a running service",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "admin.url",
+				Usage:       "Base URL of the service's admin API",
+				EnvVars:     []string{"ADMIN_URL"},
+				Destination: &client.BaseURI,
+				Value:       "http://localhost:8092",
+			},
+			&cli.StringFlag{
+				Name:        "admin.token",
+				Usage:       "Bearer token for the admin API",
+				EnvVars:     []string{"ADMIN_TOKEN"},
+				Destination: &client.Token,
+			},
+		},
+		Before: func(c *cli.Context) error {
+			client.Requester = &http.Client{Timeout: 30 * time.Second}
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "show",
+				Usage:     "Show the cached lookup of a DOI, and its age",
+				ArgsUsage: "DOI",
+				Action: func(c *cli.Context) error {
+					doi, err := doiArg(c)
+					if err != nil {
+						return err
+					}
+					entry, err := client.Entry(c.Context, doi)
+					if err != nil {
+						return err
+					}
+					return printJSON(c, entry)
+				},
+			},
+			{
+				Name:      "invalidate",
+				Usage:     "Remove the cached lookup of a DOI, so that it is looked up again",
+				ArgsUsage: "DOI",
+				Action: func(c *cli.Context) error {
+					doi, err := doiArg(c)
+					if err != nil {
+						return err
+					}
+					return client.Invalidate(c.Context, doi)
+				},
+			},
+			{
+				Name:  "purge",
+				Usage: "Remove all cached lookups",
+				Action: func(c *cli.Context) error {
+					report, err := client.Purge(c.Context)
+					if err != nil {
+						return err
+					}
+					return printJSON(c, report)
+				},
+			},
+			{
+				Name:  "stats",
+				Usage: "Show statistics of the cache",
+				Action: func(c *cli.Context) error {
+					stats, err := client.Stats(c.Context)
+					if err != nil {
+						return err
+					}
+					return printJSON(c, stats)
+				},
+			},
+		},
+	}
+}
+
+func printJSON(c *cli.Context, v interface{}) error {
+	encoder := json.NewEncoder(c.App.Writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
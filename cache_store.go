@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// CacheStore stores the results of DOI lookups for a DoiCache, until they expire.  It must be
+// safe for concurrent use, since a DoiCache calls it from many goroutines at once.  The context
+// of each call bounds how long it may take, e.g. when the store is remote.
+type CacheStore interface {
+	// Get gets the stored lookup for a DOI, or nil if there is none.  It may have expired.
+	Get(ctx context.Context, doi string) (*CachedLookup, error)
+
+	// Put stores a lookup as of the given time, and returns how many other lookups were evicted
+	// to make room for it.  Which lookups are evicted is up to the store.
+	Put(ctx context.Context, doi string, lookup *CachedLookup, now time.Time) (evicted int, err error)
+
+	// Remove removes the stored lookup for a DOI, if any
+	Remove(ctx context.Context, doi string) error
+
+	// Expire removes all lookups that have expired by the given time, and returns how many.
+	Expire(ctx context.Context, now time.Time) (expired int, err error)
+
+	// Len is the number of stored lookups, including any that have expired but not been removed
+	Len(ctx context.Context) (int, error)
+
+	// Purge removes all stored lookups, and returns how many.
+	Purge(ctx context.Context) (purged int, err error)
+}
+
+// CachedLookup is the stored result of a DOI lookup
+type CachedLookup struct {
+	Info    *DoiInfo
+	Err     error
+	Fetched time.Time // When the DOI was looked up
+	Fresh   time.Time // When the lookup becomes stale
+	Expires time.Time // When the lookup may no longer be used at all, even if stale
+}
+
+func (l *CachedLookup) expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+// CacheLocker is implemented by stores that are shared between processes, so that only one
+// of them fetches a given DOI at a time.
+type CacheLocker interface {
+	// Lock tries to take the lock for fetching a DOI.  If another process holds it, ok is false.
+	// Otherwise, unlock must be called once the fetched lookup has been stored.
+	Lock(ctx context.Context, doi string) (unlock func(), ok bool, err error)
+}
+
+// serializedLookup is the form in which a CachedLookup is stored outside of memory.  Errors
+// are reduced to their code and detail; errors without a code are stored as internal errors.
+type serializedLookup struct {
+	Info        *DoiInfo  `json:"info,omitempty"`
+	ErrorCode   string    `json:"errorCode,omitempty"`
+	ErrorDetail string    `json:"errorDetail,omitempty"`
+	Fetched     time.Time `json:"fetched"`
+	Fresh       time.Time `json:"fresh"`
+	Expires     time.Time `json:"expires"`
+}
+
+func serializeLookup(lookup *CachedLookup) ([]byte, error) {
+	serialized := serializedLookup{
+		Info:    lookup.Info,
+		Fetched: lookup.Fetched,
+		Fresh:   lookup.Fresh,
+		Expires: lookup.Expires,
+	}
+
+	if lookup.Err != nil {
+		serialized.ErrorCode, serialized.ErrorDetail = CodeInternal, lookup.Err.Error()
+
+		var coded CodedError
+		if errors.As(lookup.Err, &coded) {
+			serialized.ErrorCode = coded.ErrorCode()
+		}
+	}
+
+	return json.Marshal(serialized)
+}
+
+func deserializeLookup(value []byte) (*CachedLookup, error) {
+	var serialized serializedLookup
+	if err := json.Unmarshal(value, &serialized); err != nil {
+		return nil, err
+	}
+
+	lookup := &CachedLookup{
+		Info:    serialized.Info,
+		Fetched: serialized.Fetched,
+		Fresh:   serialized.Fresh,
+		Expires: serialized.Expires,
+	}
+
+	// Lookups stored before they could become stale are fresh until they expire
+	if lookup.Fresh.IsZero() {
+		lookup.Fresh = lookup.Expires
+	}
+
+	if serialized.ErrorCode != "" {
+		lookup.Err = &Error{Code: serialized.ErrorCode, Detail: serialized.ErrorDetail}
+	}
+
+	return lookup, nil
+}
+
+// MemoryCacheStore stores a limited number of lookups in memory, evicting the least
+// recently used.
+type MemoryCacheStore struct {
+	cache *lru.Cache
+}
+
+// NewMemoryCacheStore creates a store holding at most maxSize lookups
+func NewMemoryCacheStore(maxSize int) *MemoryCacheStore {
+	if maxSize <= 0 {
+		maxSize = CacheDefaultSize
+	}
+
+	cache, _ := lru.New(maxSize)
+	return &MemoryCacheStore{cache: cache}
+}
+
+// Get implements CacheStore
+func (s *MemoryCacheStore) Get(_ context.Context, doi string) (*CachedLookup, error) {
+	if v, ok := s.cache.Get(doi); ok {
+		return v.(*CachedLookup), nil
+	}
+	return nil, nil
+}
+
+// Put implements CacheStore
+func (s *MemoryCacheStore) Put(_ context.Context, doi string, lookup *CachedLookup, _ time.Time) (int, error) {
+	if s.cache.Add(doi, lookup) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Remove implements CacheStore
+func (s *MemoryCacheStore) Remove(_ context.Context, doi string) error {
+	s.cache.Remove(doi)
+	return nil
+}
+
+// Expire implements CacheStore
+func (s *MemoryCacheStore) Expire(_ context.Context, now time.Time) (int, error) {
+	expired := 0
+	for _, doi := range s.cache.Keys() {
+		if v, ok := s.cache.Peek(doi); ok && v.(*CachedLookup).expired(now) {
+			s.cache.Remove(doi)
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// Len implements CacheStore
+func (s *MemoryCacheStore) Len(context.Context) (int, error) {
+	return s.cache.Len(), nil
+}
+
+// Purge implements CacheStore
+func (s *MemoryCacheStore) Purge(context.Context) (int, error) {
+	purged := s.cache.Len()
+	s.cache.Purge()
+	return purged, nil
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"mime"
 	"net/http"
+	URL "net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -15,8 +22,20 @@ const (
 	headerUserAgent   = "User-Agent"
 	headerContentType = "Content-Type"
 	headerLocation    = "Location"
+
+	headerContentDisposition = "Content-Disposition"
+	headerSlug               = "Slug"
+)
+
+// Fedora binary description API
+const (
+	metadataEndpoint        = "fcr:metadata"
+	contentTypeSparqlUpdate = "application/sparql-update"
 )
 
+// fedoraCleanupTimeout is how long cleaning up after a failed deposit may take
+const fedoraCleanupTimeout = 10 * time.Second
+
 // InternalPassClient uses "private" backend URIs for interacting with the PASS repository
 // It is intended for use on private networks.  Public URIs will be
 // converted to private URIs when accessing the repository.
@@ -25,6 +44,7 @@ type InternalPassClient struct {
 	ExternalBaseURI string
 	InternalBaseURI string
 	Credentials     *Credentials
+	Log             *slog.Logger
 }
 
 type Credentials struct {
@@ -37,33 +57,117 @@ type Requester interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-func (c *InternalPassClient) PostBinary(url string, body io.Reader, contentType string) (string, error) {
-	request, err := http.NewRequest(http.MethodPost, url, body)
+// PostBinary POSTs binary content (and its file name, if known) to the given container, then
+// records its provenance and SHA-256 checksum on its fcr:metadata description.  These are
+// separate, non-transactional requests; if the description cannot be written, the binary
+// is deleted.
+func (c *InternalPassClient) PostBinary(ctx context.Context, url string, body io.Reader, contentType string, md BinaryMetadata) (string, error) {
+	location, err := c.postDescribed(ctx, "", url, body, contentType, md)
+	if err != nil {
+		if location != "" {
+			cleanupCtx, cancel := cleanupContext(ctx)
+			defer cancel()
+			c.deleteOrphan(cleanupCtx, location)
+		}
+		return "", err
+	}
+
+	return c.translateToPublic(location)
+}
+
+// postDescribed POSTs a binary and PATCHes its description, within the given transaction if
+// not empty.  If the binary was created, its location is returned even if there is an error.
+func (c *InternalPassClient) postDescribed(ctx context.Context, tx, url string, body io.Reader, contentType string, md BinaryMetadata) (string, error) {
+	digest := sha256.New()
+
+	request, err := c.newRequest(ctx, http.MethodPost, url, io.TeeReader(body, digest))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set(headerContentType, contentType)
+	if md.Filename != "" {
+		request.Header.Set(headerContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+			"filename": md.Filename,
+		}))
+		request.Header.Set(headerSlug, URL.PathEscape(md.Filename))
+	}
+
+	resp, err := c.exec(tx, request)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not post binary to %s", url)
+	}
+
+	location := resp.Header.Get(headerLocation)
+	if location == "" {
+		return "", fmt.Errorf("no location returned for binary posted to %s", url)
+	}
+
+	description := location + "/" + metadataEndpoint
+	request, err = c.newRequest(ctx, http.MethodPatch, description,
+		strings.NewReader(descriptionUpdate(md, hex.EncodeToString(digest.Sum(nil)))))
+	if err != nil {
+		return location, err
+	}
+	request.Header.Set(headerContentType, contentTypeSparqlUpdate)
+
+	if _, err = c.exec(tx, request); err != nil {
+		return location, errors.Wrapf(err, "could not update description %s", description)
+	}
+
+	return location, nil
+}
+
+func (c *InternalPassClient) deleteOrphan(ctx context.Context, location string) {
+	request, err := c.newRequest(ctx, http.MethodDelete, location, nil)
+	if err == nil {
+		_, err = c.exec("", request)
+	}
+
 	if err != nil {
-		return "", errors.Wrapf(err, "could not build http request to %s", url)
+		loggerOrDefault(c.Log).ErrorContext(ctx, "could not delete binary with no description",
+			"location", location, "error", err)
+	}
+}
+
+// cleanupContext is for cleaning up after a failed deposit, even if it failed because it was canceled
+// (e.g. when the service shuts down)
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), fedoraCleanupTimeout)
+}
+
+// newRequest builds a request to Fedora, with credentials and user agent set
+func (c *InternalPassClient) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not build http request to %s", url)
 	}
 
 	if c.Credentials != nil {
 		request.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
 	}
 	request.Header.Set(headerUserAgent, "pass-download-service")
-	request.Header.Set(headerContentType, contentType)
 
-	resp, err := c.Do(request)
-	if err != nil {
-		return "", errors.Wrapf(err, "error connecting to %s", url)
+	return request, nil
+}
+
+// exec executes a request, within the given Fedora 6 transaction if not empty.  The
+// response body is consumed and discarded.
+func (c *InternalPassClient) exec(tx string, request *http.Request) (*http.Response, error) {
+	if tx != "" {
+		request.Header.Set(headerAtomicID, tx)
 	}
 
-	if resp.StatusCode > 299 {
-		msg, _ := ioutil.ReadAll(resp.Body)
-		return "", errors.New("got error from Fedora: " + string(msg))
+	resp, err := mustSucceed(c.Do(request))
+	if err != nil {
+		return nil, err
 	}
 
-	// Consume and discard the body
-	defer resp.Body.Close()
-	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.Body != nil {
+		defer resp.Body.Close()
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+	}
 
-	return c.translateToPublic(resp.Header.Get(headerLocation))
+	return resp, nil
 }
 
 func (c *InternalPassClient) translateToPublic(uri string) (string, error) {
@@ -74,6 +178,26 @@ func (c *InternalPassClient) translateToPublic(uri string) (string, error) {
 	return strings.Replace(uri, c.InternalBaseURI, c.ExternalBaseURI, 1), nil
 }
 
+// ErrTooManyRedirects is returned by clients whose redirects are limited by LimitRedirects, when
+// a request is redirected too many times
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// LimitRedirects returns an http.Client CheckRedirect policy that stops after the given
+// number of redirects.  A span is recorded for each redirect hop.
+
+func LimitRedirects(max int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) (err error) {
+		defer func() { traceRedirect(req, via, err) }()
+
+		if len(via) >= max {
+			return fmt.Errorf("%w: maximum number of redirects reached (%v) for %v",
+				ErrTooManyRedirects, max, req.URL.String())
+		}
+
+		return nil
+	}
+}
+
 func mustSucceed(resp *http.Response, err error) (*http.Response, error) {
 	if err != nil {
 		return resp, err
@@ -0,0 +1,106 @@
+package main_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func TestPostBinaryDescribed(t *testing.T) {
+	fedora := newFakeFedora(t)
+	defer fedora.Close()
+
+	toTest := pass.InternalPassClient{
+		Requester:       fedora.Client(),
+		InternalBaseURI: fedora.URL + "/rest",
+		ExternalBaseURI: "http://example.org/rest",
+	}
+
+	uri, err := toTest.PostBinary(context.Background(), fedora.URL+"/rest/files", strings.NewReader("content"), "text/plain", pass.BinaryMetadata{
+		SourceURL: "http://example.org/file.pdf",
+		Source:    "Unpaywall",
+		Filename:  "my file.pdf",
+	})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+
+	if uri != "http://example.org/rest/files/abc" {
+		t.Errorf("did not get public uri of binary, got %s", uri)
+	}
+
+	for _, expected := range []string{
+		"<> dcterms:source <http://example.org/file.pdf>",
+		`<> dl:lookupSource "Unpaywall"`,
+	} {
+		if !strings.Contains(fedora.description, expected) {
+			t.Errorf("description update did not contain %s:\n%s", expected, fedora.description)
+		}
+	}
+
+	if fedora.deleted {
+		t.Errorf("binary should not have been deleted")
+	}
+
+	if fedora.slug != "my%20file.pdf" || fedora.disposition != `attachment; filename="my file.pdf"` {
+		t.Errorf("file name not sent to Fedora; slug: %s, content disposition: %s", fedora.slug, fedora.disposition)
+	}
+}
+
+func TestPostBinaryDescriptionFails(t *testing.T) {
+	fedora := newFakeFedora(t)
+	defer fedora.Close()
+	fedora.failOn = "PATCH /rest/files/abc/fcr:metadata"
+
+	toTest := pass.InternalPassClient{
+		Requester:       fedora.Client(),
+		InternalBaseURI: fedora.URL + "/rest",
+		ExternalBaseURI: "http://example.org/rest",
+	}
+
+	_, err := toTest.PostBinary(context.Background(), fedora.URL+"/rest/files", strings.NewReader("content"), "text/plain", pass.BinaryMetadata{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if !fedora.deleted {
+		t.Errorf("binary without a description should have been deleted")
+	}
+}
+
+func TestPostBinaryCanceled(t *testing.T) {
+	fedora := newFakeFedora(t)
+	defer fedora.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toTest := pass.InternalPassClient{
+		Requester:       cancelOn(http.MethodPatch, cancel, fedora.Client()),
+		InternalBaseURI: fedora.URL + "/rest",
+		ExternalBaseURI: "http://example.org/rest",
+	}
+
+	_, err := toTest.PostBinary(ctx, fedora.URL+"/rest/files", strings.NewReader("content"), "text/plain", pass.BinaryMetadata{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if !fedora.deleted {
+		t.Errorf("binary should have been deleted, even though the deposit was canceled")
+	}
+}
+
+// cancelOn cancels a context as a request with the given method is made, e.g. to simulate
+// shutting down in the middle of a deposit
+func cancelOn(method string, cancel context.CancelFunc, requester pass.Requester) pass.Requester {
+	return MockRequester(func(req *http.Request) (*http.Response, error) {
+		if req.Method == method {
+			cancel()
+		}
+		return requester.Do(req)
+	})
+}
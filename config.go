@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/redis/go-redis/v9"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// withConfigFile adds a --config flag to a command, naming a YAML or TOML file of settings that
+// is loaded before the command runs.  Flags and environment variables take precedence over the file.
+func withConfigFile(cmd *cli.Command) *cli.Command {
+	var path string
+
+	cmd.Flags = append([]cli.Flag{
+		&cli.StringFlag{
+			Name:        "config",
+			Usage:       "YAML or TOML file of settings, named as the flags are (e.g. cache.size).  Flags and environment variables take precedence",
+			EnvVars:     []string{"DOWNLOAD_SERVICE_CONFIG"},
+			Destination: &path,
+		},
+	}, cmd.Flags...)
+
+	action := cmd.Action
+	cmd.Action = func(c *cli.Context) error {
+		if path != "" {
+			if err := loadConfigFile(c, path); err != nil {
+				return err
+			}
+		}
+		return action(c)
+	}
+
+	return cmd
+}
+
+// loadConfigFile applies the settings in a config file to the flags of a command, unless they
+// were given as flags or environment variables.  Service settings that the command has no flag
+// for are ignored, so that one file serves every command; other settings are an error.
+func loadConfigFile(c *cli.Context, path string) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	flags := make(map[string]cli.Flag)
+	for _, flag := range c.Command.Flags {
+		for _, name := range flag.Names() {
+			flags[name] = flag
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, flag := range serveFlags(&serveOpts{}) {
+		for _, name := range flag.Names() {
+			known[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		flag, ok := flags[name]
+		switch {
+		case !known[name]:
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		case !ok, flagIsSet(c, flag):
+			continue
+		}
+
+		if err := c.Set(flag.Names()[0], settings[name]); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s", path, settings[name], name)
+		}
+	}
+
+	return nil
+}
+
+// flagIsSet determines if a flag was given on the command line, by any of its names, or in the environment
+func flagIsSet(c *cli.Context, flag cli.Flag) bool {
+	for _, name := range flag.Names() {
+		if c.IsSet(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigFile reads a YAML or TOML file, by its extension, as settings named by dotted keys.
+// Settings may be nested (cache: {size: 100}) or dotted (cache.size: 100).
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	var doc map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &doc)
+	case ".toml":
+		err = toml.Unmarshal(content, &doc)
+	default:
+		return nil, fmt.Errorf("%s: unknown config file format %q, expected .yaml, .yml, or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not parse config file: %w", path, err)
+	}
+
+	settings := make(map[string]string)
+	if err := flattenSettings(settings, "", doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// flattenSettings adds the scalar values of a document to settings, keyed by their dotted path
+func flattenSettings(settings map[string]string, prefix string, doc map[string]interface{}) error {
+	for key, value := range doc {
+		name := prefix + key
+
+		var setting string
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flattenSettings(settings, name+".", v); err != nil {
+				return err
+			}
+			continue
+		case string:
+			setting = v
+		case bool:
+			setting = strconv.FormatBool(v)
+		case int:
+			setting = strconv.Itoa(v)
+		case int64:
+			setting = strconv.FormatInt(v, 10)
+		case float64:
+			setting = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+			return fmt.Errorf("setting %q has no value", name)
+		default:
+			return fmt.Errorf("setting %q must be a single value, not %T", name, value)
+		}
+
+		if _, ok := settings[name]; ok {
+			return fmt.Errorf("setting %q is given more than once", name)
+		}
+		settings[name] = setting
+	}
+
+	return nil
+}
+
+// configCheck checks a group of settings, noting any problems
+type configCheck func(opts serveOpts, p *configProblems)
+
+// validate checks settings, so that misconfiguration is reported at startup rather than by failed
+// requests.  The error lists every problem found.
+func (opts serveOpts) validate(checks ...configCheck) error {
+	var p configProblems
+	for _, check := range checks {
+		check(opts, &p)
+	}
+	return p.err()
+}
+
+// serveChecks are the checks of the settings of the web service
+var serveChecks = []configCheck{checkUnpaywall, checkFedora, checkDownload, checkCache, checkLog, checkServer, checkTLS, checkAuth, checkOutbound}
+
+// downloadChecks are the checks of the settings of commands that download manuscripts, and store
+// them in Fedora unless a local destination is given
+func downloadChecks(out string) []configCheck {
+	if out != "" {
+		return []configCheck{checkUnpaywall, checkDownload, checkLog, checkOutbound}
+	}
+	return []configCheck{checkUnpaywall, checkFedora, checkDownload, checkLog, checkOutbound}
+}
+
+// checkUnpaywall checks the settings for looking up DOIs
+func checkUnpaywall(opts serveOpts, p *configProblems) {
+	p.url("unpaywall.baseuri", opts.unpaywallBaseURI, true)
+
+	if opts.unpaywallEmail == "" {
+		p.add("unpaywall.email", "is required, since Unpaywall asks for an email address with every request")
+	} else if addr, err := mail.ParseAddress(opts.unpaywallEmail); err != nil || addr.Address != opts.unpaywallEmail {
+		p.add("unpaywall.email", "%q is not an email address", opts.unpaywallEmail)
+	}
+}
+
+// checkFedora checks the settings for storing downloads in Fedora
+func checkFedora(opts serveOpts, p *configProblems) {
+	p.url("download.dest", opts.downloadDest, true)
+	p.url("fedora.internal.baseurl", opts.fedoraBaseURI, true)
+	p.url("fedora.public.baseurl", opts.publicFedoraBaseURI, true)
+
+	if opts.fedoraUsername != "" && opts.fedoraPassword == "" {
+		p.add("fedora.password", "is required when fedora.username is given")
+	}
+
+	if opts.fedoraVersion < 4 || opts.fedoraVersion > 6 {
+		p.add("fedora.version", "must be 4, 5, or 6, not %d", opts.fedoraVersion)
+	}
+}
+
+// checkDownload checks the settings for downloading manuscripts
+func checkDownload(opts serveOpts, p *configProblems) {
+	checkRedirects(opts, p)
+
+	if opts.maxSize < 0 {
+		p.add("download.maxsize", "must not be negative")
+	}
+
+	if opts.stagingDir != "" {
+		if info, err := os.Stat(opts.stagingDir); err != nil {
+			p.add("download.staging", "%v", err)
+		} else if !info.IsDir() {
+			p.add("download.staging", "%s is not a directory", opts.stagingDir)
+		}
+	}
+
+	if opts.clamdAddress != "" {
+		if _, _, err := net.SplitHostPort(opts.clamdAddress); err != nil {
+			p.add("clamd.address", "%q is not a host:port address", opts.clamdAddress)
+		}
+	}
+}
+
+// checkCache checks the settings of the DOI cache
+func checkCache(opts serveOpts, p *configProblems) {
+	if opts.cacheSize < 0 {
+		p.add("cache.size", "must not be negative")
+	}
+
+	for _, age := range []struct {
+		setting string
+		age     time.Duration
+	}{
+		{"cache.maxage", opts.cacheMaxAge},
+		{"cache.notfoundage", opts.cacheNotFoundAge},
+		{"cache.errorage", opts.cacheErrorAge},
+		{"cache.stalewhilerevalidate", opts.cacheRevalidate},
+		{"cache.staleiferror", opts.cacheStaleIfError},
+	} {
+		if age.age < 0 {
+			p.add(age.setting, "must not be negative")
+		}
+	}
+
+	if opts.cachePath != "" && opts.cacheRedisURL != "" {
+		p.add("cache.redis", "may not be given with cache.path, since lookups are cached in one or the other")
+	}
+
+	if opts.cacheRedisURL != "" {
+		if _, err := redis.ParseURL(opts.cacheRedisURL); err != nil {
+			p.add("cache.redis", "%v", err)
+		}
+	}
+
+	if opts.cacheWarm != "" && opts.cacheWarmWorkers < 1 {
+		p.add("cache.warm.concurrency", "must be at least 1")
+	}
+
+	if opts.cacheWarmRate < 0 {
+		p.add("cache.warm.rate", "must not be negative")
+	}
+}
+
+// checkLog checks the logging settings
+func checkLog(opts serveOpts, p *configProblems) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.logLevel)); err != nil {
+		p.add("log.level", "must be debug, info, warn, or error, not %q", opts.logLevel)
+	}
+
+	if format := strings.ToLower(opts.logFormat); format != "json" && format != "text" {
+		p.add("log.format", "must be json or text, not %q", opts.logFormat)
+	}
+}
+
+// checkServer checks the settings of the web service's own servers
+func checkServer(opts serveOpts, p *configProblems) {
+	p.port("port", opts.port)
+
+	if opts.adminToken != "" {
+		p.port("admin.port", opts.adminPort)
+		if opts.adminPort == opts.port {
+			p.add("admin.port", "must differ from port, since the admin API is served separately")
+		}
+	}
+
+	if opts.drainDelay < 0 {
+		p.add("drain.delay", "must not be negative")
+	}
+
+	if opts.drainTimeout < 0 {
+		p.add("drain.timeout", "must not be negative")
+	}
+
+	p.url("otlp.endpoint", opts.otlpEndpoint, false)
+}
+
+// checkTLS checks the settings for serving HTTPS
+func checkTLS(opts serveOpts, p *configProblems) {
+	if (opts.tlsCert == "") != (opts.tlsKey == "") {
+		p.add("tls.key", "must be given with tls.cert")
+	} else if opts.tlsCert != "" {
+		if _, err := tls.LoadX509KeyPair(opts.tlsCert, opts.tlsKey); err != nil {
+			p.add("tls.cert", "%v", err)
+		}
+	}
+
+	if opts.tlsClientCA != "" {
+		if opts.tlsCert == "" {
+			p.add("tls.clientca", "requires tls.cert, since client certificates are only verified over HTTPS")
+		}
+		if _, err := LoadCertPool(nil, opts.tlsClientCA); err != nil {
+			p.add("tls.clientca", "%v", err)
+		}
+	}
+}
+
+// checkAuth checks the settings for authenticating API requests
+func checkAuth(opts serveOpts, p *configProblems) {
+	if proxies, err := ParseProxies(opts.authProxies); err != nil {
+		p.add("auth.proxies", "%v", err)
+	} else if opts.authHeader != "" && len(proxies) == 0 {
+		p.add("auth.proxies", "is required when auth.header is given, since anyone else could set the header")
+	}
+
+	if opts.authJWKS != "" {
+		if _, err := LoadJWKS(opts.authJWKS); err != nil {
+			p.add("auth.jwks", "%v", err)
+		}
+	} else if opts.authIssuer != "" || opts.authAudience != "" {
+		p.add("auth.jwks", "is required when auth.jwt.issuer or auth.jwt.audience is given")
+	}
+
+	if opts.authAPIKeys != "" {
+		if _, err := LoadAPIKeys(opts.authAPIKeys); err != nil {
+			p.add("auth.apikeys", "%v", err)
+		}
+	}
+
+	// The API is only open to anyone when that is asked for, not by omission
+	configured := opts.authHeader != "" || opts.authJWKS != "" || opts.authAPIKeys != "" || opts.tlsClientCA != ""
+	switch {
+	case !configured && !opts.authDisabled:
+		p.add("auth.disabled", "must be set to serve the API without authentication, since none of auth.header, auth.jwks, auth.apikeys, or tls.clientca is given")
+	case configured && opts.authDisabled:
+		p.add("auth.disabled", "must not be set when authentication is configured")
+	}
+}
+
+// checkRedirects checks the limit on redirects followed by outbound requests
+func checkRedirects(opts serveOpts, p *configProblems) {
+	if opts.maxredirects < 0 {
+		p.add("download.maxredirects", "must not be negative")
+	}
+}
+
+// checkOutbound checks the settings of connections to other services
+func checkOutbound(opts serveOpts, p *configProblems) {
+	if opts.caBundle != "" {
+		if _, err := LoadCertPool(nil, opts.caBundle); err != nil {
+			p.add("http.cabundle", "%v", err)
+		}
+	}
+}
+
+// configProblems collects the problems found by validating settings
+type configProblems []string
+
+func (p *configProblems) add(setting, format string, args ...interface{}) {
+	*p = append(*p, setting+": "+fmt.Sprintf(format, args...))
+}
+
+// url notes a problem if the setting is not an http(s) URL
+func (p *configProblems) url(setting, value string, required bool) {
+	if value == "" {
+		if required {
+			p.add(setting, "is required")
+		}
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p.add(setting, "%q is not an http or https URL", value)
+	}
+}
+
+// port notes a problem if the setting is not a TCP port
+func (p *configProblems) port(setting string, port int) {
+	if port < 1 || port > 65535 {
+		p.add(setting, "%d is not a port number", port)
+	}
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(p, "\n  "))
+}
+
+// configCommand works with the service's configuration, without starting it
+func configCommand() *cli.Command {
+	var opts serveOpts
+
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Work with the service's configuration",
+		Subcommands: []*cli.Command{
+			withConfigFile(&cli.Command{
+				Name:  "validate",
+				Usage: "Check the settings the service would start with, from a config file, flags, and the environment",
+				Flags: serveFlags(&opts),
+				Action: func(c *cli.Context) error {
+					if err := opts.validate(serveChecks...); err != nil {
+						return err
+					}
+					_, err := fmt.Fprintln(c.App.Writer, "configuration is valid")
+					return err
+				},
+			}),
+		},
+	}
+}
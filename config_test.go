@@ -0,0 +1,325 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/urfave/cli/v2"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	expected := map[string]string{
+		"unpaywall.email":         "pass@example.org",
+		"cache.size":              "200",
+		"cache.maxage":            "10m",
+		"cache.warm.rate":         "0.5",
+		"download.requirepdf":     "false",
+		"fedora.public.baseurl":   "https://pass.example.org/fcrepo/rest",
+		"fedora.internal.baseurl": "http://fcrepo:8080/fcrepo/rest",
+	}
+
+	cases := map[string]string{
+		"config.yaml": `
+unpaywall:
+  email: pass@example.org
+cache:
+  size: 200
+  maxage: 10m
+  warm.rate: 0.5
+download.requirepdf: false
+fedora:
+  public.baseurl: https://pass.example.org/fcrepo/rest
+  internal:
+    baseurl: http://fcrepo:8080/fcrepo/rest
+`,
+		"config.toml": `
+"download.requirepdf" = false
+
+[unpaywall]
+email = "pass@example.org"
+
+[cache]
+size = 200
+maxage = "10m"
+"warm.rate" = 0.5
+
+[fedora]
+"public.baseurl" = "https://pass.example.org/fcrepo/rest"
+internal.baseurl = "http://fcrepo:8080/fcrepo/rest"
+`,
+	}
+
+	for name, content := range cases {
+		name, content := name, content
+		t.Run(name, func(t *testing.T) {
+			path := writeConfig(t, name, content)
+
+			settings, err := readConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diffs := deep.Equal(settings, expected); len(diffs) > 0 {
+				t.Errorf("unexpected settings: %v", diffs)
+			}
+		})
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	cases := map[string]string{
+		"config.json": `{"port": 8091}`,
+		"list.yaml":   "cache:\n  warm: [a, b]\n",
+		"empty.yaml":  "port:\n",
+		"bad.yaml":    "port: [\n",
+		"bad.toml":    "port = \n",
+	}
+
+	for name, content := range cases {
+		name, content := name, content
+		t.Run(name, func(t *testing.T) {
+			if _, err := readConfigFile(writeConfig(t, name, content)); err == nil {
+				t.Errorf("expected an error reading %s", content)
+			}
+		})
+	}
+
+	if _, err := readConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("expected an error reading a missing file")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+port: 9000
+cache.size: 200
+log.level: debug
+fedora.password: secret
+download.requirepdf: true
+`)
+
+	t.Setenv("DOI_CACHE_SIZE", "300")
+
+	opts := runWithConfig(t, "--config", path, "--port", "9001")
+
+	if opts.port != 9001 {
+		t.Errorf("expected the port flag to take precedence, got %d", opts.port)
+	}
+	if opts.cacheSize != 300 {
+		t.Errorf("expected the environment to take precedence, got cache size %d", opts.cacheSize)
+	}
+	if opts.logLevel != "debug" || opts.fedoraPassword != "secret" || !opts.requirePDF {
+		t.Errorf("expected settings from the config file, got %+v", opts)
+	}
+
+	opts = runWithConfig(t, "--config", path, "-p", "other")
+	if opts.fedoraPassword != "other" {
+		t.Errorf("expected the password alias to take precedence, got %s", opts.fedoraPassword)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	cases := map[string]string{
+		"unknown setting": "cahce.size: 100\n",
+		"invalid value":   "cache.maxage: forever\n",
+	}
+
+	for name, content := range cases {
+		content := content
+		t.Run(name, func(t *testing.T) {
+			path := writeConfig(t, "config.yaml", content)
+
+			app := &cli.App{Commands: []*cli.Command{withConfigFile(&cli.Command{
+				Name:   "serve",
+				Flags:  serveFlags(&serveOpts{}),
+				Action: func(*cli.Context) error { return nil },
+			})}}
+
+			if err := app.Run([]string{"app", "serve", "--config", path}); err == nil {
+				t.Errorf("expected an error loading %s", content)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileIgnoresOtherCommandsSettings(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "unpaywall.email: pass@example.org\nfedora.version: 6\n")
+
+	var opts serveOpts
+	app := &cli.App{Commands: []*cli.Command{withConfigFile(&cli.Command{
+		Name:   "lookup",
+		Flags:  unpaywallFlags(&opts),
+		Action: func(*cli.Context) error { return nil },
+	})}}
+
+	if err := app.Run([]string{"app", "lookup", "--config", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.unpaywallEmail != "pass@example.org" {
+		t.Errorf("expected the email from the config file, got %q", opts.unpaywallEmail)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() serveOpts {
+		return serveOpts{
+			port:                8091,
+			downloadDest:        "http://fcrepo:8080/fcrepo/rest/bin",
+			unpaywallEmail:      "pass@example.org",
+			unpaywallBaseURI:    "https://api.unpaywall.org/v2",
+			publicFedoraBaseURI: "https://pass.example.org/fcrepo/rest",
+			fedoraBaseURI:       "http://fcrepo:8080/fcrepo/rest",
+			fedoraVersion:       4,
+			maxredirects:        10,
+			logLevel:            "info",
+			logFormat:           "json",
+			cacheMaxAge:         time.Hour,
+			adminPort:           8092,
+			authDisabled:        true,
+		}
+	}
+
+	if err := valid().validate(serveChecks...); err != nil {
+		t.Fatalf("expected valid settings, got %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		modify  func(*serveOpts)
+		problem string
+	}{
+		{"no dest", func(o *serveOpts) { o.downloadDest = "" }, "download.dest: is required"},
+		{"relative dest", func(o *serveOpts) { o.downloadDest = "/fcrepo/rest/bin" }, "download.dest:"},
+		{"no email", func(o *serveOpts) { o.unpaywallEmail = "" }, "unpaywall.email: is required"},
+		{"bad email", func(o *serveOpts) { o.unpaywallEmail = "pass" }, "unpaywall.email:"},
+		{"named email", func(o *serveOpts) { o.unpaywallEmail = "PASS <pass@example.org>" }, "unpaywall.email:"},
+		{"no baseuri", func(o *serveOpts) { o.unpaywallBaseURI = "" }, "unpaywall.baseuri: is required"},
+		{"no fedora", func(o *serveOpts) { o.fedoraBaseURI = "" }, "fedora.internal.baseurl: is required"},
+		{"no public fedora", func(o *serveOpts) { o.publicFedoraBaseURI = "" }, "fedora.public.baseurl: is required"},
+		{"no password", func(o *serveOpts) { o.fedoraUsername = "admin" }, "fedora.password:"},
+		{"fedora version", func(o *serveOpts) { o.fedoraVersion = 3 }, "fedora.version:"},
+		{"port", func(o *serveOpts) { o.port = 70000 }, "port:"},
+		{"admin port", func(o *serveOpts) { o.adminToken, o.adminPort = "secret", 8091 }, "admin.port:"},
+		{"redirects", func(o *serveOpts) { o.maxredirects = -1 }, "download.maxredirects:"},
+		{"staging", func(o *serveOpts) { o.stagingDir = "/does/not/exist" }, "download.staging:"},
+		{"clamd", func(o *serveOpts) { o.clamdAddress = "clamd" }, "clamd.address:"},
+		{"cache age", func(o *serveOpts) { o.cacheMaxAge = -time.Second }, "cache.maxage:"},
+		{"cache stores", func(o *serveOpts) { o.cachePath, o.cacheRedisURL = "cache.db", "redis://redis:6379" }, "cache.redis:"},
+		{"redis url", func(o *serveOpts) { o.cacheRedisURL = "http://redis" }, "cache.redis:"},
+		{"warm concurrency", func(o *serveOpts) { o.cacheWarm = "dois.txt" }, "cache.warm.concurrency:"},
+		{"log level", func(o *serveOpts) { o.logLevel = "loud" }, "log.level:"},
+		{"log format", func(o *serveOpts) { o.logFormat = "xml" }, "log.format:"},
+		{"otlp", func(o *serveOpts) { o.otlpEndpoint = "collector:4318" }, "otlp.endpoint:"},
+		{"tls key", func(o *serveOpts) { o.tlsCert = "cert.pem" }, "tls.key: must be given with tls.cert"},
+		{"tls cert", func(o *serveOpts) { o.tlsCert, o.tlsKey = "/does/not/exist.pem", "/does/not/exist.key" }, "tls.cert:"},
+		{"client ca", func(o *serveOpts) { o.tlsClientCA = "/does/not/exist.pem" }, "tls.clientca: requires tls.cert"},
+		{"ca bundle", func(o *serveOpts) { o.caBundle = "/does/not/exist.pem" }, "http.cabundle:"},
+		{"auth proxies", func(o *serveOpts) { o.authHeader = "Eppn" }, "auth.proxies: is required"},
+		{"bad proxies", func(o *serveOpts) { o.authProxies = "proxy" }, "auth.proxies:"},
+		{"jwks", func(o *serveOpts) { o.authJWKS = "/does/not/exist.json" }, "auth.jwks:"},
+		{"jwt issuer", func(o *serveOpts) { o.authIssuer = "https://idp.example.org" }, "auth.jwks: is required"},
+		{"api keys", func(o *serveOpts) { o.authAPIKeys = "/does/not/exist" }, "auth.apikeys:"},
+		{"no auth", func(o *serveOpts) { o.authDisabled = false }, "auth.disabled: must be set"},
+		{"auth disabled", func(o *serveOpts) { o.authHeader, o.authProxies = "Eppn", "10.0.0.0/8" }, "auth.disabled: must not be set"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opts := valid()
+			c.modify(&opts)
+
+			err := opts.validate(serveChecks...)
+			if err == nil || !strings.Contains(err.Error(), c.problem) {
+				t.Errorf("expected problem %q, got %v", c.problem, err)
+			}
+		})
+	}
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+	err := serveOpts{logLevel: "info", logFormat: "json", port: 8091, fedoraVersion: 4}.validate(serveChecks...)
+	if err == nil {
+		t.Fatal("expected missing settings to be invalid")
+	}
+
+	for _, setting := range []string{"download.dest", "unpaywall.email", "unpaywall.baseuri", "fedora.internal.baseurl", "fedora.public.baseurl"} {
+		if !strings.Contains(err.Error(), setting+": is required") {
+			t.Errorf("expected %s to be required, got %v", setting, err)
+		}
+	}
+}
+
+func TestDownloadChecks(t *testing.T) {
+	opts := serveOpts{
+		unpaywallEmail:   "pass@example.org",
+		unpaywallBaseURI: "https://api.unpaywall.org/v2",
+		logLevel:         "info",
+		logFormat:        "json",
+	}
+
+	if err := opts.validate(downloadChecks("manuscripts")...); err != nil {
+		t.Errorf("expected Fedora settings to be unnecessary with a local destination, got %v", err)
+	}
+
+	if err := opts.validate(downloadChecks("")...); err == nil {
+		t.Errorf("expected Fedora settings to be required")
+	}
+}
+
+// runWithConfig runs a serve-like command with the given arguments, returning its settings
+func runWithConfig(t *testing.T, args ...string) serveOpts {
+	var opts serveOpts
+
+	app := &cli.App{Commands: []*cli.Command{withConfigFile(&cli.Command{
+		Name:   "serve",
+		Flags:  serveFlags(&opts),
+		Action: func(*cli.Context) error { return nil },
+	})}}
+
+	if err := app.Run(append([]string{"app", "serve"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return opts
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookupMaxRedirects(t *testing.T) {
+	unpaywall := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/moved") {
+			http.Redirect(w, r, "/moved"+r.URL.RequestURI(), http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"doi": "10.1234/a", "oa_locations": []}`))
+	}))
+	defer unpaywall.Close()
+
+	lookup := func(args ...string) error {
+		app := &cli.App{Writer: io.Discard, ErrWriter: io.Discard, Commands: []*cli.Command{lookupCommand()}}
+		return app.Run(append([]string{"app", "lookup", "--unpaywall.email", "pass@example.org",
+			"--unpaywall.baseuri", unpaywall.URL}, append(args, "10.1234/a")...))
+	}
+
+	if err := lookup(); err != nil {
+		t.Errorf("expected the redirect to be followed, got %v", err)
+	}
+	if err := lookup("--download.maxredirects", "0"); err == nil || !strings.Contains(err.Error(), "1 of 1 lookups failed") {
+		t.Errorf("expected the redirect not to be followed, got %v", err)
+	}
+}
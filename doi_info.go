@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+)
+
 // DoiInfo contains information associated with a DOI, most notably
 // the available open access manuscripts
 type DoiInfo struct {
@@ -14,4 +19,59 @@ type Manuscript struct {
 	Type                  string `json:"type"`            // The MIME type of the manuscript file
 	Source                string `json:"source"`          // The API where we found the file
 	Name                  string `json:"name"`            // The file name
+	Version               string `json:"version"`         // The manuscript version (e.g. acceptedVersion)
+}
+
+// Ranking policies, for choosing among the manuscripts of a DOI
+const (
+	RankAccepted  = "accepted"  // Accepted versions first, since they are what PASS deposits, then published, then submitted
+	RankPublished = "published" // Published versions first, then accepted, then submitted
+	RankAsFound   = "as-found"  // In the order they were found
+)
+
+// rankingVersions is the order of preference of manuscript versions, for each ranking policy.
+// Versions that are not listed come last.
+var rankingVersions = map[string][]string{
+	RankAccepted:  {"acceptedVersion", "publishedVersion", "submittedVersion"},
+	RankPublished: {"publishedVersion", "acceptedVersion", "submittedVersion"},
+	RankAsFound:   nil,
+}
+
+// RankManuscripts orders manuscripts from best to worst, by the RankAccepted policy
+func RankManuscripts(manuscripts []Manuscript) []Manuscript {
+	ranked, _ := RankManuscriptsBy(RankAccepted, manuscripts)
+	return ranked
+}
+
+// RankManuscriptsBy orders manuscripts from best to worst, by version according to the given
+// policy.  Manuscripts of the same version keep the order in which they were found.
+func RankManuscriptsBy(policy string, manuscripts []Manuscript) ([]Manuscript, error) {
+	versions, ok := rankingVersions[policy]
+	if !ok {
+		return nil, fmt.Errorf("unknown ranking policy %q, expected %s, %s, or %s", policy, RankAccepted, RankPublished, RankAsFound)
+	}
+
+	rank := func(m Manuscript) int {
+		for i, version := range versions {
+			if m.Version == version {
+				return i
+			}
+		}
+		return len(versions)
+	}
+
+	ranked := append([]Manuscript(nil), manuscripts...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return rank(ranked[i]) < rank(ranked[j])
+	})
+
+	return ranked, nil
+}
+
+// BestManuscript is the top-ranked manuscript of a DOI, or nil if it has none
+func (d *DoiInfo) BestManuscript() *Manuscript {
+	if d == nil || len(d.Manuscripts) == 0 {
+		return nil
+	}
+	return &RankManuscripts(d.Manuscripts)[0]
 }
@@ -1,53 +1,170 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	lru "github.com/hashicorp/golang-lru"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// cacheSweepInterval is how often expired entries are swept from the cache
+const cacheSweepInterval = 1 * time.Minute
+
+// cacheLockPollInterval is how often to check whether another process has finished fetching
+// a DOI, when the store is shared
+const cacheLockPollInterval = 100 * time.Millisecond
+
+// cacheStoreTimeout is how long a call to the store may take, since it may be remote
+const cacheStoreTimeout = 5 * time.Second
+
+// cacheFetchTimeout is how long fetching a DOI may take.  Fetches are shared by every caller
+// waiting for them, so are not canceled along with the caller that started them.
+const cacheFetchTimeout = 1 * time.Minute
+
+const (
+	CacheDefaultSize        = 100
+	CacheDefaultAge         = 1 * time.Minute
+	CacheDefaultNotFoundAge = 10 * time.Minute
+	CacheDefaultErrorAge    = 5 * time.Second
+)
+
+// States of cached lookups
 const (
-	CacheDefaultSize = 100
-	CacheDefaultAge  = 1 * time.Minute
+	CacheStateFound    = "found"     // The DOI was looked up successfully
+	CacheStateStale    = "stale"     // The DOI was looked up successfully, but is being looked up again
+	CacheStateNotFound = "not_found" // The DOI is not known, or is invalid
+	CacheStateError    = "error"     // The lookup failed, and will not be retried until the entry expires
 )
 
 // DoiCacheConfig configures a doi cache
 type DoiCacheConfig struct {
-	MaxAge  time.Duration // Maximum age before evicting a cache entry
-	MaxSize int           // Maximum number of entries
+	MaxAge      time.Duration // Maximum age of a successful lookup before it is refreshed
+	NotFoundAge time.Duration // Maximum age before evicting a DOI that is not found, or invalid
+	ErrorAge    time.Duration // Maximum age before evicting a failed lookup, i.e. how long to back off before retrying
+
+	// How long after MaxAge a successful lookup is still served, while it is refreshed in the
+	// background.  After that, callers wait for it to be refreshed.  Zero disables this.
+	StaleWhileRevalidate time.Duration
+
+	// How long after MaxAge a successful lookup is still served, if refreshing it fails.
+	// Zero disables this.
+	StaleIfError time.Duration
+
+	MaxSize  int              // Maximum number of entries, if Store is nil
+	Store    CacheStore       // Where lookups are stored.  If nil, they are stored in memory
+	Observer CacheObserver    // Notified of cache hits, misses, and evictions.  Can be nil
+	Clock    func() time.Time // Current time, for determining expiry.  If nil, time.Now is used
+	Log      *slog.Logger
+}
+
+// CacheObserver is notified of cache activity, e.g. for collecting metrics.  Hits are
+// reported along with the state of the cached entry.
+type CacheObserver interface {
+	CacheHit(state string)
+	CacheMiss()
+	CacheEvicted()
 }
 
 // DoiCache caches information for a limited number of DOIs, for a specified amount of time.
+// Lookups are kept in a CacheStore, each along with when it expires.  Expired lookups are
+// removed when they are next read, or by a sweep of the whole store, which is done lazily
+// as the cache is used.
 type DoiCache struct {
-	m      sync.Mutex
-	config DoiCacheConfig
-	cache  *lru.Cache
+	m          sync.Mutex // Guards what is pending, refreshing, and swept, but not the store
+	config     DoiCacheConfig
+	ages       atomic.Pointer[cacheAges] // From config, unless the cache is reconfigured
+	pending    map[string]*cacheEntry    // Entries whose values are still being fetched
+	refreshing map[string]bool           // DOIs being refreshed in the background
+	lastSweep  time.Time
+	counts     cacheCounts
+}
+
+// cacheAges are how long lookups are cached, which can change while the cache is in use
+type cacheAges struct {
+	maxAge               time.Duration
+	notFoundAge          time.Duration
+	errorAge             time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+// newCacheAges takes the ages from a config, using defaults for any that are not given
+func newCacheAges(cfg DoiCacheConfig) *cacheAges {
+	ages := &cacheAges{
+		maxAge:               cfg.MaxAge,
+		notFoundAge:          cfg.NotFoundAge,
+		errorAge:             cfg.ErrorAge,
+		staleWhileRevalidate: cfg.StaleWhileRevalidate,
+		staleIfError:         cfg.StaleIfError,
+	}
+
+	if ages.maxAge <= 0 {
+		ages.maxAge = CacheDefaultAge
+	}
+
+	if ages.notFoundAge <= 0 {
+		ages.notFoundAge = CacheDefaultNotFoundAge
+	}
+
+	if ages.errorAge <= 0 {
+		ages.errorAge = CacheDefaultErrorAge
+	}
+
+	return ages
 }
 
+// cacheEntry is the result of looking up a DOI.  Its done channel is closed once the result
+// has been fetched, and it is immutable after that.
 type cacheEntry struct {
-	sync.RWMutex
-	info *DoiInfo
-	ok   bool
-	err  error
+	done  chan struct{}
+	info  *DoiInfo
+	err   error
+	state string
 }
 
+// cacheEntryDone is the done channel of entries whose results are already known
+var cacheEntryDone = func() chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}()
+
 // NewDoiCache initializes a new doi cache
 func NewDoiCache(cfg DoiCacheConfig) *DoiCache {
 	if cfg.MaxSize <= 0 {
 		cfg.MaxSize = CacheDefaultSize
 	}
 
-	if cfg.MaxAge <= 0 {
-		cfg.MaxAge = CacheDefaultAge
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryCacheStore(cfg.MaxSize)
 	}
 
-	cache, _ := lru.New(cfg.MaxSize)
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
 
-	return &DoiCache{
-		cache:  cache,
-		config: cfg,
+	cache := &DoiCache{
+		config:     cfg,
+		pending:    make(map[string]*cacheEntry),
+		refreshing: make(map[string]bool),
+		lastSweep:  cfg.Clock(),
+		counts:     cacheCounts{hits: make(map[string]int64)},
 	}
+	cache.ages.Store(newCacheAges(cfg))
+
+	return cache
+}
+
+// Reconfigure changes how long lookups are cached to the ages in the given config, e.g. when the
+// service's configuration is reloaded.  Lookups already cached keep their expiry, and the rest of
+// the config is ignored.
+func (c *DoiCache) Reconfigure(cfg DoiCacheConfig) {
+	c.ages.Store(newCacheAges(cfg))
 }
 
 // GetOrAdd adds an entry to the cache via invoking the given generator
@@ -58,57 +175,545 @@ func NewDoiCache(cfg DoiCacheConfig) *DoiCache {
 // The doi fetch function provides the doi info to cache, possibly performing
 // a fetch that blocks for a while.  Future calls to GetOrAdd for the same doi
 // will block until a value is available or the function returns an error.
-// In the case of an error, the value will not be added to the cache,
-// and all pending Get requests will return the error
-func (c *DoiCache) GetOrAdd(doi string, fetchDoi func() (*DoiInfo, error)) (*DoiInfo, error) {
+// Errors are cached too, and returned to all pending and future Get requests until
+// they expire.  DOIs that are not found (or invalid) are cached for NotFoundAge, and
+// any other errors for ErrorAge.
+//
+// The fetch function is called in its own goroutine, with a context that is not canceled along
+// with ctx, since others may be waiting for its result, but times out after cacheFetchTimeout.
+// If ctx is done first, GetOrAdd returns its error without waiting any longer.
+//
+// Successful lookups older than MaxAge are returned at once if they are within the
+// StaleWhileRevalidate window, and refreshed in the background by the same fetch function.  If a lookup could not be refreshed,
+// it is returned instead of the error for as long as it is within the StaleIfError window.
+func (c *DoiCache) GetOrAdd(ctx context.Context, doi string, fetchDoi func(context.Context) (*DoiInfo, error)) (*DoiInfo, error) {
+	ctx, span := tracer().Start(ctx, "DoiCache.GetOrAdd", trace.WithAttributes(attribute.String("doi", doi)))
+	defer span.End()
+
+	entry, created, stale, refresh := c.entry(ctx, doi)
+	if refresh {
+		go c.refresh(ctx, doi, stale, fetchDoi)
+	}
 
-	// Critical section.  Check that we don't have a cached entry, and create/add a locked one if not
-	cached, entry, found, err := func() (*DoiInfo, *cacheEntry, bool, error) {
+	if created {
+		span.SetAttributes(attribute.String("cache.result", "miss"))
+		c.observe(CacheObserver.CacheMiss)
+		go c.fill(ctx, doi, entry, stale, fetchDoi)
+	}
+
+	// Wait for the value, if it is still being fetched
+	coalesced := false
+	select {
+	case <-entry.done:
+	default:
+		coalesced = !created
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			span.SetAttributes(attribute.String("cache.result", "canceled"))
+			return nil, ctx.Err()
+		}
+	}
+
+	if !created {
+		if coalesced {
+			span.SetAttributes(attribute.String("cache.result", "coalesced"))
+		} else {
+			span.SetAttributes(attribute.String("cache.result", "hit"))
+		}
+		c.observe(func(o CacheObserver) { o.CacheHit(entry.state) })
+	}
+	span.SetAttributes(attribute.String("cache.state", entry.state))
+
+	return entry.info, entry.err
+}
+
+// entry gets an entry for a DOI, either from its pending fetch, or an unexpired lookup in
+// the store.  If there is neither, it adds a new pending entry, for the caller to fetch the
+// value of while others wait for it.  Any stale lookup is returned too, and whether the caller
+// should refresh it in the background.  The store is read without holding the lock, so that
+// lookups of other DOIs need not wait for it.
+func (c *DoiCache) entry(ctx context.Context, doi string) (entry *cacheEntry, created bool, stale *CachedLookup, refresh bool) {
+	if entry := c.pendingEntry(doi); entry != nil {
+		return entry, false, nil, false
+	}
+
+	now := c.config.Clock()
+	c.sweepIfDue(ctx, now)
+
+	if lookup := c.get(ctx, doi); lookup != nil {
+		switch {
+		case now.Before(lookup.Fresh):
+			return lookupEntry(lookup, cacheState(lookup.Err)), false, nil, false
+		case now.Before(lookup.Fresh.Add(c.ages.Load().staleWhileRevalidate)) && now.Before(lookup.Expires):
+			return lookupEntry(lookup, CacheStateStale), false, lookup, c.startRefresh(doi)
+		case now.Before(lookup.Expires):
+			stale = lookup
+		default:
+			c.evict(ctx, doi)
+		}
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Someone may have started fetching it while the store was read
+	if entry, ok := c.pending[doi]; ok {
+		return entry, false, nil, false
+	}
+
+	entry = &cacheEntry{done: make(chan struct{})}
+	c.pending[doi] = entry
+
+	return entry, true, stale, false
+}
+
+// pendingEntry gets the entry of a DOI that is being fetched, if any
+func (c *DoiCache) pendingEntry(doi string) *cacheEntry {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.pending[doi]
+}
+
+// startRefresh marks a DOI as being refreshed, and returns whether it was not already
+func (c *DoiCache) startRefresh(doi string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.refreshing[doi] {
+		return false
+	}
+	c.refreshing[doi] = true
+	return true
+}
+
+// lookupEntry creates a ready entry from a stored lookup
+func lookupEntry(lookup *CachedLookup, state string) *cacheEntry {
+	return &cacheEntry{
+		done:  cacheEntryDone,
+		info:  lookup.Info,
+		err:   lookup.Err,
+		state: state,
+	}
+}
+
+// fill executes the doi fetch function for a new entry, stores the result, and marks the
+// entry done.  If the store is shared with other processes, the DOI is fetched by only one of
+// them at a time; the others wait for its result.  If the fetch panics, those waiting get an
+// error, and nothing is stored.
+func (c *DoiCache) fill(ctx context.Context, doi string, entry *cacheEntry, stale *CachedLookup, fetchDoi func(context.Context) (*DoiInfo, error)) {
+	ctx, cancel := fetchContext(ctx)
+	defer cancel()
+
+	var lookup *CachedLookup
+	unlock := func() {}
+
+	defer func() { unlock() }()
+	defer func() { c.settle(ctx, doi, entry, lookup) }()
+	defer func() {
+		if r := recover(); r != nil {
+			c.log().ErrorContext(ctx, "DOI lookup panicked", "doi", doi, "panic", r)
+			lookup = nil
+			entry.info, entry.state = nil, CacheStateError
+			entry.err = errorf(CodeInternal, nil, "could not look up %s", doi)
+		}
+	}()
+
+	if locker, ok := c.config.Store.(CacheLocker); ok {
+		var stored *CachedLookup
+		if stored, unlock = c.lockOrWait(ctx, locker, doi); stored != nil {
+			entry.info, entry.err, entry.state = stored.Info, stored.Err, cacheState(stored.Err)
+			return
+		}
+	}
+
+	info, err := fetchDoi(ctx)
+	lookup = c.result(ctx, doi, info, err, stale)
+
+	entry.info, entry.err, entry.state = lookup.Info, lookup.Err, cacheState(lookup.Err)
+}
+
+// refresh fetches a stale lookup again, and stores the result
+func (c *DoiCache) refresh(ctx context.Context, doi string, stale *CachedLookup, fetchDoi func(context.Context) (*DoiInfo, error)) {
+	ctx, cancel := fetchContext(ctx)
+	defer cancel()
+
+	defer func() {
 		c.m.Lock()
 		defer c.m.Unlock()
+		delete(c.refreshing, doi)
+	}()
+
+	// If other processes share the store, only refresh if none of them are
+	if locker, ok := c.config.Store.(CacheLocker); ok {
+		unlock, ok, err := c.lock(ctx, locker, doi)
+		if err != nil || !ok {
+			return
+		}
+		defer unlock()
+	}
+
+	info, err := fetchDoi(ctx)
+	c.put(ctx, doi, c.result(ctx, doi, info, err, stale))
+}
+
+// fetchContext is the context a DOI is fetched under: that of the caller that started the fetch,
+// but not canceled along with it
+func fetchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cacheFetchTimeout)
+}
+
+// result creates the lookup to store for the result of a fetch.  If it failed, and there is a
+// stale lookup within the StaleIfError window, that is kept instead, but not refreshed again
+// until ErrorAge has passed.
+func (c *DoiCache) result(ctx context.Context, doi string, info *DoiInfo, err error, stale *CachedLookup) *CachedLookup {
+	ages := c.ages.Load()
+	now := c.config.Clock()
+	state := cacheState(err)
+
+	if state == CacheStateError && stale != nil && now.Before(stale.Fresh.Add(ages.staleIfError)) {
+		c.log().WarnContext(ctx, "could not refresh DOI lookup, so using stale lookup", "doi", doi, "error", err)
+
+		kept := *stale
+		kept.Fresh = now.Add(ages.errorAge)
+		if kept.Expires.Before(kept.Fresh) {
+			kept.Expires = kept.Fresh
+		}
+		return &kept
+	}
+
+	fresh := now.Add(ages.of(state))
+	expires := fresh
+	if state == CacheStateFound {
+		expires = fresh.Add(max(ages.staleWhileRevalidate, ages.staleIfError))
+	}
+
+	return &CachedLookup{
+		Info:    info,
+		Err:     err,
+		Fetched: now,
+		Fresh:   fresh,
+		Expires: expires,
+	}
+}
+
+// lockOrWait takes the lock for fetching a DOI from a shared store, or waits until whoever
+// holds it has stored their lookup.  It returns either the stored lookup, or a function for
+// releasing the lock.  If the lock cannot be taken at all, the DOI is fetched without it.
+func (c *DoiCache) lockOrWait(ctx context.Context, locker CacheLocker, doi string) (*CachedLookup, func()) {
+	for {
+		unlock, ok, err := c.lock(ctx, locker, doi)
+		if err != nil {
+			c.log().WarnContext(ctx, "could not lock DOI in cache", "doi", doi, "error", err)
+			return nil, func() {}
+		}
+
+		// Someone may have stored a lookup since we last looked
+		lookup := c.stored(ctx, doi)
 
-		cached, ok, err := c.get(doi)
 		if ok {
-			return cached, nil, ok, err
+			if lookup != nil {
+				unlock()
+				return lookup, func() {}
+			}
+			return nil, unlock
 		}
-		entry := &cacheEntry{}
-		entry.Lock()
-		c.cache.Add(doi, entry)
 
-		return nil, entry, false, nil
-	}()
+		if lookup != nil {
+			return lookup, func() {}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, func() {}
+		case <-time.After(cacheLockPollInterval):
+		}
+	}
+}
+
+// lock tries to take the lock for fetching a DOI from a shared store
+func (c *DoiCache) lock(ctx context.Context, locker CacheLocker, doi string) (func(), bool, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+	return locker.Lock(ctx, doi)
+}
 
-	if found {
-		return cached, err
+// stored gets a fresh lookup from the store, if there is one
+func (c *DoiCache) stored(ctx context.Context, doi string) *CachedLookup {
+	lookup := c.get(ctx, doi)
+	if lookup == nil || !c.config.Clock().Before(lookup.Fresh) {
+		return nil
 	}
 
-	// OK, now execute the doi fetch function and unlock the cache entry when done.
-	defer entry.Unlock()
+	return lookup
+}
+
+// get reads the lookup of a DOI from the store, or nil if there is none or it cannot be read
+func (c *DoiCache) get(ctx context.Context, doi string) *CachedLookup {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	lookup, err := c.config.Store.Get(ctx, doi)
+	if err != nil {
+		c.log().WarnContext(ctx, "could not read from DOI cache", "doi", doi, "error", err)
+		return nil
+	}
+
+	return lookup
+}
 
-	if entry.info, err = fetchDoi(); err != nil {
-		entry.ok = false
-		c.cache.Remove(doi)
+// storeContext bounds a call to the store
+func storeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cacheStoreTimeout)
+}
+
+// settle stores the lookup, if any, releases those waiting for the entry, and then removes
+// that exact entry from those pending, so that later callers find the lookup in the store
+func (c *DoiCache) settle(ctx context.Context, doi string, entry *cacheEntry, lookup *CachedLookup) {
+	if lookup != nil {
+		c.put(ctx, doi, lookup)
+	}
+	close(entry.done)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.pending[doi] == entry {
+		delete(c.pending, doi)
+	}
+}
+
+// put stores a lookup
+func (c *DoiCache) put(ctx context.Context, doi string, lookup *CachedLookup) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	evicted, err := c.config.Store.Put(ctx, doi, lookup, c.config.Clock())
+	if err != nil {
+		c.log().WarnContext(ctx, "could not write to DOI cache", "doi", doi, "error", err)
+		return
+	}
+
+	c.evicted(evicted)
+}
+
+// evict removes an expired lookup from the store
+func (c *DoiCache) evict(ctx context.Context, doi string) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	if err := c.config.Store.Remove(ctx, doi); err != nil {
+		c.log().WarnContext(ctx, "could not remove from DOI cache", "doi", doi, "error", err)
+		return
+	}
+	c.evicted(1)
+}
+
+// sweepIfDue removes all expired lookups from the store, if it has not been swept for a while
+func (c *DoiCache) sweepIfDue(ctx context.Context, now time.Time) {
+	c.m.Lock()
+	due := now.Sub(c.lastSweep) >= cacheSweepInterval
+	if due {
+		c.lastSweep = now
+	}
+	c.m.Unlock()
+
+	if !due {
+		return
+	}
+
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	expired, err := c.config.Store.Expire(ctx, now)
+	if err != nil {
+		c.log().WarnContext(ctx, "could not sweep DOI cache", "error", err)
+	}
+	c.evicted(expired)
+}
+
+func (c *DoiCache) evicted(count int) {
+	for i := 0; i < count; i++ {
+		c.observe(CacheObserver.CacheEvicted)
+	}
+}
+
+func (c *DoiCache) observe(event func(CacheObserver)) {
+	event(&c.counts)
+	if c.config.Observer != nil {
+		event(c.config.Observer)
+	}
+}
+
+func (c *DoiCache) log() *slog.Logger {
+	return loggerOrDefault(c.config.Log)
+}
+
+// cacheState determines the state of a cache entry from the result of its lookup.  Errors
+// that are facts about a DOI (it is not found, or invalid) are distinguished from failures
+// to find out about it.
+func cacheState(err error) string {
+	if err == nil {
+		return CacheStateFound
+	}
+
+	var coded CodedError
+	if errors.As(err, &coded) {
+		switch coded.ErrorCode() {
+		case CodeDOINotFound, CodeInvalidDOI:
+			return CacheStateNotFound
+		}
+	}
+
+	return CacheStateError
+}
+
+// of is how long an entry in the given state is cached
+func (a *cacheAges) of(state string) time.Duration {
+	switch state {
+	case CacheStateNotFound:
+		return a.notFoundAge
+	case CacheStateError:
+		return a.errorAge
+	default:
+		return a.maxAge
+	}
+}
+
+// CacheEntryReport describes the stored lookup of a DOI
+type CacheEntryReport struct {
+	DOI        string       `json:"doi"`
+	State      string       `json:"state"`
+	Fetched    *time.Time   `json:"fetched,omitempty"`
+	AgeSeconds float64      `json:"ageSeconds,omitempty"`
+	Fresh      time.Time    `json:"fresh"`
+	Expires    time.Time    `json:"expires"`
+	Info       *DoiInfo     `json:"info,omitempty"`
+	Error      *ErrorReport `json:"error,omitempty"`
+	Pending    bool         `json:"pending"`
+}
+
+// CacheStats describes the contents and activity of a cache, since it was created
+type CacheStats struct {
+	Entries    int              `json:"entries"`    // Stored lookups, including expired ones not yet removed
+	Pending    int              `json:"pending"`    // DOIs being fetched by callers waiting for them
+	Refreshing int              `json:"refreshing"` // DOIs being refreshed in the background
+	Hits       map[string]int64 `json:"hits"`       // Hits, by the state of the entry
+	Misses     int64            `json:"misses"`
+	Evictions  int64            `json:"evictions"`
+}
+
+// Entry reports the stored lookup of a DOI, without fetching it, or nil if there is none
+// that has not expired.  It is not counted as a hit or miss.
+func (c *DoiCache) Entry(ctx context.Context, doi string) (*CacheEntryReport, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	now := c.config.Clock()
+	lookup, err := c.config.Store.Get(ctx, doi)
+	if err != nil || lookup == nil || lookup.expired(now) {
 		return nil, err
 	}
 
-	entry.ok = true
-	time.AfterFunc(c.config.MaxAge, func() {
-		c.cache.Remove(doi)
-	})
+	report := &CacheEntryReport{
+		DOI:     doi,
+		State:   cacheState(lookup.Err),
+		Fresh:   lookup.Fresh,
+		Expires: lookup.Expires,
+		Info:    lookup.Info,
+		Pending: c.isPending(doi),
+	}
+
+	if !now.Before(lookup.Fresh) {
+		report.State = CacheStateStale
+	}
+
+	if !lookup.Fetched.IsZero() {
+		report.Fetched = &lookup.Fetched
+		report.AgeSeconds = now.Sub(lookup.Fetched).Seconds()
+	}
+
+	report.Error = reportError(lookup.Err)
+
+	return report, nil
+}
+
+// isPending is whether a DOI is being fetched or refreshed
+func (c *DoiCache) isPending(doi string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.pending[doi] != nil || c.refreshing[doi]
+}
 
-	return entry.info, nil
+// Invalidate removes the stored lookup of a DOI, so that it is fetched again when next
+// requested.  A fetch that is already in progress is not affected.
+func (c *DoiCache) Invalidate(ctx context.Context, doi string) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	return c.config.Store.Remove(ctx, doi)
+}
+
+// Purge removes all stored lookups, and returns how many were removed
+func (c *DoiCache) Purge(ctx context.Context) (int, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	return c.config.Store.Purge(ctx)
 }
 
-func (c *DoiCache) get(doi string) (info *DoiInfo, ok bool, err error) {
-	v, ok := c.cache.Get(doi)
+// Stats reports the contents and activity of the cache
+func (c *DoiCache) Stats(ctx context.Context) (CacheStats, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	entries, err := c.config.Store.Len(ctx)
 
-	// Nothing in cache
-	if !ok {
-		return nil, false, nil
+	c.m.Lock()
+	stats := CacheStats{
+		Entries:    entries,
+		Pending:    len(c.pending),
+		Refreshing: len(c.refreshing),
 	}
+	c.m.Unlock()
 
-	e := v.(*cacheEntry)
-	e.RLock()
-	defer e.RUnlock()
-	return e.info, e.ok, e.err
+	stats.Hits, stats.Misses, stats.Evictions = c.counts.get()
+	return stats, err
+}
+
+// cacheCounts counts cache activity, for Stats
+type cacheCounts struct {
+	m         sync.Mutex
+	hits      map[string]int64
+	misses    int64
+	evictions int64
+}
+
+func (c *cacheCounts) CacheHit(state string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.hits[state]++
+}
+
+func (c *cacheCounts) CacheMiss() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.misses++
+}
+
+func (c *cacheCounts) CacheEvicted() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.evictions++
+}
+
+func (c *cacheCounts) get() (map[string]int64, int64, int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	hits := make(map[string]int64, len(c.hits))
+	for state, count := range c.hits {
+		hits[state] = count
+	}
+	return hits, c.misses, c.evictions
 }
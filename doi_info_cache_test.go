@@ -1,9 +1,12 @@
 package main_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,7 +26,7 @@ func TestSimpleCase(t *testing.T) {
 		},
 	}
 
-	manuscripts, _ := cache.GetOrAdd("foo", func() (*pass.DoiInfo, error) {
+	manuscripts, _ := cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
 		return &pass.DoiInfo{
 			Manuscripts: []pass.Manuscript{
 				{
@@ -53,20 +56,83 @@ func TestEvictSize(t *testing.T) {
 }
 
 func TestEvictTimeout(t *testing.T) {
+	clock := newFakeClock()
 	cache := pass.NewDoiCache(pass.DoiCacheConfig{
 		MaxSize: 1,
-		MaxAge:  1 * time.Microsecond,
+		MaxAge:  1 * time.Minute,
+		Clock:   clock.Now,
 	})
 
 	assertComputed(t, cache, "foo")
 
-	for i := 1; i < 10; i++ {
-		if didCompute(cache, "foo") {
-			return // good, it was evicted and had to be re-computed
-		}
-		time.Sleep(10 * time.Millisecond)
+	clock.Advance(59 * time.Second)
+	assertNotComputed(t, cache, "foo")
+
+	clock.Advance(1 * time.Second)
+	assertComputed(t, cache, "foo") // expired, so had to be re-computed
+}
+
+// Make sure an entry that was evicted and re-added expires according to the new entry's age,
+// not the old one's
+func TestEvictReadded(t *testing.T) {
+	clock := newFakeClock()
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		MaxSize: 1,
+		MaxAge:  1 * time.Minute,
+		Clock:   clock.Now,
+	})
+
+	assertComputed(t, cache, "foo")
+	assertComputed(t, cache, "bar") // evicts foo
+
+	clock.Advance(30 * time.Second)
+	assertComputed(t, cache, "foo") // re-added, expiring in a minute
+
+	clock.Advance(45 * time.Second) // past the original entry's expiry
+	assertNotComputed(t, cache, "foo")
+
+	clock.Advance(15 * time.Second)
+	assertComputed(t, cache, "foo")
+}
+
+// Make sure reconfigured ages apply to new lookups, but not to those already cached
+func TestReconfigure(t *testing.T) {
+	clock := newFakeClock()
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		MaxAge: 1 * time.Minute,
+		Clock:  clock.Now,
+	})
+
+	assertComputed(t, cache, "foo")
+
+	cache.Reconfigure(pass.DoiCacheConfig{MaxAge: 1 * time.Hour})
+	assertComputed(t, cache, "bar")
+
+	clock.Advance(1 * time.Minute)
+	assertComputed(t, cache, "foo") // expired with its original age
+	assertNotComputed(t, cache, "bar")
+}
+
+func TestSweep(t *testing.T) {
+	clock := newFakeClock()
+	observer := &recordingObserver{}
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		MaxAge:   1 * time.Minute,
+		Clock:    clock.Now,
+		Observer: observer,
+	})
+
+	assertComputed(t, cache, "foo")
+	assertComputed(t, cache, "bar")
+
+	clock.Advance(2 * time.Minute)
+
+	// Expired entries are swept, even though they are not read
+	assertComputed(t, cache, "baz")
+
+	if observer.evictions != 2 {
+		t.Errorf("expected expired entries to be swept, got %d evictions", observer.evictions)
 	}
-	t.Fatalf("Cache entry should have been evicted by now")
 }
 
 // Make sure only one simultaneous/contested add wins
@@ -92,7 +158,7 @@ func TestContested(t *testing.T) {
 	// 1: This will execute and calculate the result once we signal it to do so
 	// on the exec channel
 	go func() {
-		result, _ := cache.GetOrAdd("foo", func() (*pass.DoiInfo, error) {
+		result, _ := cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
 			ready1 <- true
 			<-exec1
 			return &pass.DoiInfo{
@@ -113,7 +179,7 @@ func TestContested(t *testing.T) {
 	// 2: This will block, and return the result from 1
 	go func() {
 		ready2 <- true
-		result, _ := cache.GetOrAdd("foo", func() (*pass.DoiInfo, error) {
+		result, _ := cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
 			// This shouldn't execute
 			errChan <- errors.New("cache function executed when not expected to")
 			return &pass.DoiInfo{}, nil
@@ -141,9 +207,13 @@ func TestContested(t *testing.T) {
 }
 
 func TestError(t *testing.T) {
-	cache := pass.NewDoiCache(pass.DoiCacheConfig{})
+	clock := newFakeClock()
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		ErrorAge: 1 * time.Second,
+		Clock:    clock.Now,
+	})
 
-	_, err := cache.GetOrAdd("foo", func() (*pass.DoiInfo, error) {
+	_, err := cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
 		return nil, fmt.Errorf("error")
 	})
 
@@ -151,10 +221,162 @@ func TestError(t *testing.T) {
 		t.Fatalf("Should have gotten an error!")
 	}
 
-	// After our error, we should be able to add just fine
+	// After our error has expired, we should be able to add just fine
+	assertNotComputed(t, cache, "foo")
+	clock.Advance(1 * time.Second)
 	assertComputed(t, cache, "foo")
 }
 
+func TestNegativeCaching(t *testing.T) {
+	notFound := &pass.Error{Code: pass.CodeDOINotFound, Detail: "not found"}
+	failed := errors.New("unpaywall is down")
+
+	cases := []struct {
+		name  string
+		err   error
+		state string
+	}{
+		{"found", nil, pass.CacheStateFound},
+		{"not found", notFound, pass.CacheStateNotFound},
+		{"error", failed, pass.CacheStateError},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			observer := &recordingObserver{}
+			cache := pass.NewDoiCache(pass.DoiCacheConfig{
+				MaxAge:      1 * time.Hour,
+				NotFoundAge: 1 * time.Hour,
+				ErrorAge:    1 * time.Hour,
+				Observer:    observer,
+			})
+
+			fetched := 0
+			fetch := func(context.Context) (*pass.DoiInfo, error) {
+				fetched++
+				return &pass.DoiInfo{}, c.err
+			}
+
+			for i := 0; i < 3; i++ {
+				if _, err := cache.GetOrAdd(context.Background(), "foo", fetch); err != c.err {
+					t.Fatalf("expected error %v, got %v", c.err, err)
+				}
+			}
+
+			if fetched != 1 {
+				t.Errorf("expected result to be cached, but fetched %d times", fetched)
+			}
+
+			if diffs := deep.Equal(observer.hits, []string{c.state, c.state}); len(diffs) > 0 {
+				t.Errorf("unexpected cache hits %v", observer.hits)
+			}
+		})
+	}
+}
+
+func TestNegativeCachingAges(t *testing.T) {
+	clock := newFakeClock()
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		MaxAge:      1 * time.Hour,
+		NotFoundAge: 1 * time.Hour,
+		ErrorAge:    1 * time.Second,
+		Clock:       clock.Now,
+	})
+
+	_, _ = cache.GetOrAdd(context.Background(), "notFound", func(context.Context) (*pass.DoiInfo, error) {
+		return nil, &pass.Error{Code: pass.CodeInvalidDOI}
+	})
+	_, _ = cache.GetOrAdd(context.Background(), "failed", func(context.Context) (*pass.DoiInfo, error) {
+		return nil, errors.New("unpaywall is down")
+	})
+
+	clock.Advance(1 * time.Second)
+
+	assertNotComputed(t, cache, "notFound")
+	assertComputed(t, cache, "failed")
+}
+
+// Make sure callers waiting on a failing fetch see its error, rather than fetching again
+func TestContestedError(t *testing.T) {
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{})
+	failed := errors.New("unpaywall is down")
+
+	exec1 := make(chan bool)
+	ready1 := make(chan bool)
+	ready2 := make(chan bool)
+	result1 := make(chan error)
+	result2 := make(chan error)
+
+	go func() {
+		_, err := cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
+			ready1 <- true
+			<-exec1
+			return nil, failed
+		})
+		result1 <- err
+	}()
+
+	<-ready1
+
+	go func() {
+		ready2 <- true
+		_, err := cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
+			return nil, errors.New("cache function executed when not expected to")
+		})
+		result2 <- err
+	}()
+
+	<-ready2
+
+	exec1 <- true
+
+	if err := <-result1; err != failed {
+		t.Errorf("expected error %v, got %v", failed, err)
+	}
+
+	if err := <-result2; err != failed {
+		t.Errorf("waiting caller expected error %v, got %v", failed, err)
+	}
+}
+
+type recordingObserver struct {
+	hits      []string
+	evictions int
+}
+
+func (r *recordingObserver) CacheHit(state string) {
+	r.hits = append(r.hits, state)
+}
+
+func (r *recordingObserver) CacheMiss() {}
+
+func (r *recordingObserver) CacheEvicted() {
+	r.evictions++
+}
+
+// fakeClock is a clock that only moves when advanced
+type fakeClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.now = f.now.Add(d)
+}
+
 // expects the cache to execute the generator function for a given key
 func assertComputed(t *testing.T, cache *pass.DoiCache, doi string) {
 	t.Helper()
@@ -172,7 +394,7 @@ func assertNotComputed(t *testing.T, cache *pass.DoiCache, doi string) {
 
 func didCompute(cache *pass.DoiCache, doi string) bool {
 	var computed bool
-	_, _ = cache.GetOrAdd(doi, func() (*pass.DoiInfo, error) {
+	_, _ = cache.GetOrAdd(context.Background(), doi, func(context.Context) (*pass.DoiInfo, error) {
 		computed = true
 		return &pass.DoiInfo{
 			Manuscripts: []pass.Manuscript{
@@ -186,3 +408,248 @@ func didCompute(cache *pass.DoiCache, doi string) bool {
 
 	return computed
 }
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	clock := newFakeClock()
+	store := &notifyingStore{CacheStore: pass.NewMemoryCacheStore(10), puts: make(chan string, 10)}
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		MaxAge:               1 * time.Minute,
+		StaleWhileRevalidate: 1 * time.Minute,
+		Store:                store,
+		Clock:                clock.Now,
+	})
+
+	first := &pass.DoiInfo{Manuscripts: []pass.Manuscript{{Location: "first"}}}
+	second := &pass.DoiInfo{Manuscripts: []pass.Manuscript{{Location: "second"}}}
+
+	_, _ = cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
+		return first, nil
+	})
+	<-store.puts
+
+	clock.Advance(90 * time.Second)
+
+	// The stale lookup is returned at once, while it is refreshed in the background
+	var refreshes int32
+	release := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	refresh := func(ctx context.Context) (*pass.DoiInfo, error) {
+		atomic.AddInt32(&refreshes, 1)
+		<-release
+		return second, ctx.Err()
+	}
+
+	for i := 0; i < 2; i++ {
+		if info, _ := cache.GetOrAdd(ctx, "foo", refresh); info != first {
+			t.Fatalf("expected stale lookup")
+		}
+	}
+	cancel() // The refresh outlives the request that started it
+
+	close(release)
+	<-store.puts
+
+	info, _ := cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
+		t.Fatal("refreshed lookup should have been cached")
+		return nil, nil
+	})
+	if info != second {
+		t.Errorf("expected refreshed lookup")
+	}
+
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Errorf("expected one refresh, got %d", n)
+	}
+
+	// Once past the stale-while-revalidate window, callers wait for the refresh
+	clock.Advance(2 * time.Minute)
+	assertComputed(t, cache, "foo")
+}
+
+func TestStaleIfError(t *testing.T) {
+	clock := newFakeClock()
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{
+		MaxAge:       1 * time.Minute,
+		ErrorAge:     5 * time.Second,
+		StaleIfError: 1 * time.Hour,
+		Clock:        clock.Now,
+	})
+
+	info := &pass.DoiInfo{Manuscripts: []pass.Manuscript{{Location: "foo"}}}
+	_, _ = cache.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
+		return info, nil
+	})
+
+	failed := errors.New("unpaywall is down")
+	fetched := 0
+	failing := func(context.Context) (*pass.DoiInfo, error) {
+		fetched++
+		return nil, failed
+	}
+
+	// Unpaywall is down, so the stale lookup is returned rather than the error
+	clock.Advance(2 * time.Minute)
+	if result, err := cache.GetOrAdd(context.Background(), "foo", failing); result != info || err != nil {
+		t.Fatalf("expected stale lookup, got %v, %v", result, err)
+	}
+
+	// ... and not looked up again until ErrorAge has passed
+	if result, _ := cache.GetOrAdd(context.Background(), "foo", failing); result != info || fetched != 1 {
+		t.Fatalf("expected stale lookup without fetching again, fetched %d times", fetched)
+	}
+
+	clock.Advance(5 * time.Second)
+	if result, _ := cache.GetOrAdd(context.Background(), "foo", failing); result != info || fetched != 2 {
+		t.Fatalf("expected stale lookup after fetching again, fetched %d times", fetched)
+	}
+
+	// Past the stale-if-error window, the error is returned
+	clock.Advance(1 * time.Hour)
+	if _, err := cache.GetOrAdd(context.Background(), "foo", failing); err != failed {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+func TestCanceledCaller(t *testing.T) {
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+
+	fetch := func(ctx context.Context) (*pass.DoiInfo, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("unpaywall request failed: %w", err)
+		}
+		return &pass.DoiInfo{Manuscripts: []pass.Manuscript{{Location: "http://example.org/a.pdf"}}}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := cache.GetOrAdd(ctx, "10.1/a", fetch)
+		canceled <- err
+	}()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := cache.GetOrAdd(context.Background(), "10.1/a", fetch)
+		waited <- err
+	}()
+
+	// The first caller gives up at once, without waiting for the lookup
+	cancel()
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the caller to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("canceled caller waited for the lookup")
+	}
+
+	// ... but the lookup is not canceled with it, since others are waiting for it
+	close(release)
+	if err := <-waited; err != nil {
+		t.Errorf("expected a waiting caller to get the lookup, got %v", err)
+	}
+
+	info, err := cache.GetOrAdd(context.Background(), "10.1/a", fetch)
+	if err != nil || len(info.Manuscripts) != 1 {
+		t.Errorf("expected the lookup to be cached, got %v, %v", info, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single fetch, got %d", n)
+	}
+}
+
+func TestPanickingFetch(t *testing.T) {
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{})
+
+	_, err := cache.GetOrAdd(context.Background(), "10.1/a", func(context.Context) (*pass.DoiInfo, error) {
+		panic("oops")
+	})
+
+	var coded pass.CodedError
+	if !errors.As(err, &coded) || coded.ErrorCode() != pass.CodeInternal {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+
+	// The failure is not cached
+	assertComputed(t, cache, "10.1/a")
+}
+
+// notifyingStore reports the DOIs of lookups once they are stored
+type notifyingStore struct {
+	pass.CacheStore
+	puts chan string
+}
+
+func (s *notifyingStore) Put(ctx context.Context, doi string, lookup *pass.CachedLookup, now time.Time) (int, error) {
+	evicted, err := s.CacheStore.Put(ctx, doi, lookup, now)
+	s.puts <- doi
+	return evicted, err
+}
+
+// blockingStore blocks reads of one DOI until released
+type blockingStore struct {
+	pass.CacheStore
+	doi     string
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Get(ctx context.Context, doi string) (*pass.CachedLookup, error) {
+	if doi == s.doi {
+		close(s.blocked)
+		<-s.release
+	}
+	return s.CacheStore.Get(ctx, doi)
+}
+
+func TestSlowStore(t *testing.T) {
+	store := &blockingStore{
+		CacheStore: pass.NewMemoryCacheStore(10),
+		doi:        "10.1/slow",
+		blocked:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{Store: store})
+
+	fetch := func(context.Context) (*pass.DoiInfo, error) {
+		return &pass.DoiInfo{}, nil
+	}
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := cache.GetOrAdd(context.Background(), "10.1/slow", fetch)
+		slow <- err
+	}()
+	<-store.blocked
+
+	// Reading one DOI from the store does not hold up lookups of others
+	fast := make(chan error, 1)
+	go func() {
+		_, err := cache.GetOrAdd(context.Background(), "10.1/fast", fetch)
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lookup waited for the store to read another DOI")
+	}
+
+	close(store.release)
+	if err := <-slow; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
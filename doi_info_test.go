@@ -0,0 +1,36 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func TestRankManuscripts(t *testing.T) {
+	manuscripts := []pass.Manuscript{
+		{Location: "1", Version: "submittedVersion"},
+		{Location: "2", Version: "publishedVersion"},
+		{Location: "3"},
+		{Location: "4", Version: "acceptedVersion"},
+		{Location: "5", Version: "publishedVersion"},
+	}
+
+	var order []string
+	for _, m := range pass.RankManuscripts(manuscripts) {
+		order = append(order, m.Location)
+	}
+
+	if diffs := deep.Equal(order, []string{"4", "2", "5", "1", "3"}); len(diffs) > 0 {
+		t.Errorf("unexpected ranking: %v", diffs)
+	}
+
+	info := &pass.DoiInfo{Manuscripts: manuscripts}
+	if best := info.BestManuscript(); best == nil || best.Location != "4" {
+		t.Errorf("unexpected best manuscript %+v", best)
+	}
+
+	if best := (&pass.DoiInfo{}).BestManuscript(); best != nil {
+		t.Errorf("expected no best manuscript, got %+v", best)
+	}
+}
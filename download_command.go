@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// downloadCommand runs the download pipeline from the command line, depositing a single
+// manuscript without a running service
+func downloadCommand() *cli.Command {
+	var opts serveOpts
+	var doi, url, out string
+	var best bool
+
+	return withConfigFile(&cli.Command{
+		Name:  "download",
+		Usage: "Download a manuscript of a DOI, verify it, and store it in Fedora (or a local file), then print where it is",
+		Flags: concatFlags([]cli.Flag{
+			&cli.StringFlag{
+				Name:        "doi",
+				Usage:       "DOI of the manuscript",
+				Destination: &doi,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "url",
+				Usage:       "URL of the manuscript, which must be one found by looking up the DOI",
+				Destination: &url,
+			},
+			&cli.BoolFlag{
+				Name:        "best",
+				Usage:       "Download the top-ranked manuscript of the DOI, rather than a given URL",
+				Destination: &best,
+			},
+			&cli.StringFlag{
+				Name:        "out",
+				Aliases:     []string{"o"},
+				Usage:       "File or directory to store the manuscript in, instead of Fedora",
+				Destination: &out,
+			},
+		}, unpaywallFlags(&opts), outboundFlags(&opts), fedoraFlags(&opts), downloadFlags(&opts), logFlags(&opts)),
+		Action: func(c *cli.Context) error {
+			if (url == "") == !best {
+				return fmt.Errorf("exactly one of --url or --best must be given")
+			}
+
+			if err := opts.validate(downloadChecks(out)...); err != nil {
+				return err
+			}
+
+			logger, err := NewLogger(c.App.ErrWriter, opts.logLevel, opts.logFormat)
+			if err != nil {
+				return err
+			}
+
+			rootCAs, err := opts.rootCAs()
+			if err != nil {
+				return err
+			}
+
+			requester := LogRequests(logger, newHTTPClient(opts.maxredirects, rootCAs))
+
+			// The DOI is looked up to find the best manuscript, then again to verify it
+			unpaywall := UnpaywallService{
+				HTTP:    requester,
+				Baseuri: opts.unpaywallBaseURI,
+				Email:   opts.unpaywallEmail,
+				Cache:   NewDoiCache(DoiCacheConfig{Log: logger}),
+				Log:     logger,
+			}
+
+			doi = trimDOI(doi)
+			if best {
+				info, err := unpaywall.Lookup(c.Context, doi)
+				if err != nil {
+					return err
+				}
+
+				manuscript := info.BestManuscript()
+				if manuscript == nil {
+					return fmt.Errorf("no manuscripts found for %s", doi)
+				}
+				url = manuscript.Location
+				logger.InfoContext(c.Context, "downloading best manuscript", "doi", doi, "url", url, "version", manuscript.Version)
+			}
+
+			var store BinaryStore = LocalFileStore{}
+			if out != "" {
+				opts.downloadDest = out
+			} else {
+				if opts.downloadDest == "" {
+					return fmt.Errorf("either --download.dest or --out must be given")
+				}
+				_, store = opts.fedora(PropagateTrace(requester), logger)
+			}
+
+			result, err := opts.downloadService(requester, unpaywall, store, logger).Download(c.Context, doi, url)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintln(c.App.Writer, result.Location)
+			return err
+		},
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestDownloadBestEscapedLocation(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/10.1234/a":
+			fmt.Fprintf(w, `{"oa_locations": [{"url_for_pdf": "%s/files/a%%20b.pdf", "version": "acceptedVersion"}]}`, server.URL)
+		case "/files/a b.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			_, _ = w.Write([]byte("%PDF-1.4 manuscript"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	var out strings.Builder
+	app := &cli.App{Writer: &out, ErrWriter: io.Discard, Commands: []*cli.Command{downloadCommand()}}
+
+	err := app.Run([]string{"app", "download", "--doi", "10.1234/a", "--best", "--out", dir,
+		"--unpaywall.email", "pass@example.org", "--unpaywall.baseuri", server.URL + "/v2"})
+	if err != nil {
+		t.Fatalf("expected the escaped location to be downloaded, got %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "a b.pdf"))
+	if err != nil || string(content) != "%PDF-1.4 manuscript" {
+		t.Errorf("expected the manuscript to be stored, got %q, %v (printed %s)", content, err, out.String())
+	}
+}
@@ -1,68 +1,262 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	URL "net/url"
+	"os"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 type DownloadService struct {
-	HTTP   Requester     // Http client for downloading content
-	Fedora BinaryStore   // PASS/Fedora client
-	Dest   string        // URL of Fedora container where binaries will be deposited into
-	DOIs   LookupService // DOI lookup service (for verifying validity of download URI for a given DOI)
+	HTTP       Requester     // Http client for downloading content
+	Fedora     BinaryStore   // PASS/Fedora client
+	Dest       string        // URL of Fedora container where binaries will be deposited into
+	DOIs       LookupService // DOI lookup service (for verifying validity of download URI for a given DOI)
+	Scanner    Scanner       // Malware scanner.  Can be nil if no scanning is desired
+	StagingDir string        // Directory where content is staged while scanning.  If empty, the system temp dir is used.
+	Audit      AuditLog      // Audit trail of deposited and rejected content.  Can be nil.
+	MaxSize    int64         // Maximum size of content, in bytes.  Zero means no limit.
+	RequirePDF bool          // If true, content that does not look like a PDF is refused
+	Log        *slog.Logger
 }
 
 // Binarystore is a place where binary content can be POSTed.  If successful, the URL of the
 // newly-stored content will be returned.
 type BinaryStore interface {
-	PostBinary(url string, body io.Reader, contentType string) (string, error)
+	PostBinary(ctx context.Context, url string, body io.Reader, contentType string, md BinaryMetadata) (string, error)
+}
+
+// BinaryMetadata describes binary content that is being stored, for stores that
+// are capable of recording a description alongside the content.
+type BinaryMetadata struct {
+	SourceURL             string    // URL the content was downloaded from
+	FinalURL              string    // URL the content was ultimately retrieved from, after redirects
+	DOI                   string    // DOI the content is associated with
+	Source                string    // The API where the manuscript was found (e.g. Unpaywall)
+	RepositoryInstitution string    // The repository where the manuscript was found
+	Version               string    // The manuscript version (e.g. acceptedVersion)
+	DownloadedAt          time.Time // When the content was downloaded
+	ServiceVersion        string    // Version of the download service
+	Filename              string    // File name of the content
+}
+
+// DownloadResult describes manuscript content that has been downloaded into Fedora
+type DownloadResult struct {
+	Location string // URL of the newly-stored binary
+	Filename string // File name of the binary, if known
+	SHA256   string // Hex-encoded SHA-256 checksum of the stored content
 }
 
 // Download verifies that the given url is valid for a given DOI, downloads it into Fedora,
-// Then returns the resulting URL of the binary.  Note:  It does *not* create a File entity.
-func (d DownloadService) Download(doi, url string) (string, error) {
-	info, err := d.DOIs.Lookup(doi)
+// Then returns the resulting URL and file name of the binary.  Note:  It does *not* create a File entity.
+func (d DownloadService) Download(ctx context.Context, doi, url string) (*DownloadResult, error) {
+	info, err := d.DOIs.Lookup(ctx, doi)
 	if err != nil {
-		return "", errors.Wrapf(err, "could not lookup doi %s", doi)
+		return nil, errors.Wrapf(err, "could not lookup doi %s", doi)
 	}
 
-	if err = d.verifyURL(doi, info, url); err != nil {
-		return "", errors.Wrapf(err, "could not validate url %s for doi %s", url, doi)
+	manuscript, err := d.verifyURL(ctx, info, url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not validate url %s for doi %s", url, doi)
 	}
 
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	resp, err := d.HTTP.Do(req)
+	if errors.Is(err, ErrTooManyRedirects) {
+		return nil, errorf(CodeTooManyRedirects, err, "content URL redirected too many times")
+	}
 	if err != nil {
-		return "", errors.Wrapf(err, "could not fetch content URL")
+		return nil, errorf(CodeUpstreamUnavailable, err, "could not fetch content URL")
 	}
 
+	resp.Body = newTracedBody(ctx, "transfer body", resp.Body)
 	defer resp.Body.Close()
 
 	if resp.StatusCode > 303 {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return "", errors.Errorf("download of '%s' failed with %d %s", url, resp.StatusCode, string(body))
+		return nil, errorf(CodeUpstreamError, nil, "download of '%s' failed with %d %s", url, resp.StatusCode, string(body))
+	}
+
+	if d.MaxSize > 0 && resp.ContentLength > d.MaxSize {
+		return nil, errorf(CodeTooLarge, nil, "content of %s is %d bytes, which exceeds the limit of %d bytes",
+			url, resp.ContentLength, d.MaxSize)
+	}
+
+	finalURL := url
+	if resp.Request != nil {
+		finalURL = resp.Request.URL.String()
+	}
+
+	filename := bestFilename(resp, manuscript, url)
+
+	limited := &limitReader{Reader: resp.Body, limit: d.MaxSize}
+
+	var content io.Reader = limited
+	if d.RequirePDF {
+		content, err = sniffPDF(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not verify content of %s", url)
+		}
+	}
+
+	if d.Scanner != nil {
+		staged, err := d.stage(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not stage content of %s", url)
+		}
+		defer func() {
+			staged.Close()
+			os.Remove(staged.Name())
+		}()
+
+		if err = d.Scanner.Scan(staged); err != nil {
+			var infected ErrorInfected
+			if errors.As(err, &infected) {
+				d.audit(ctx, AuditEvent{Action: AuditInfected, DOI: doi, URL: url, Detail: string(infected)})
+			}
+			return nil, errors.Wrapf(err, "could not scan content of %s", url)
+		}
+
+		if _, err = staged.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.Wrapf(err, "could not read staged content of %s", url)
+		}
+		content = staged
+	}
+
+	digest := sha256.New()
+	content = io.TeeReader(content, digest)
+
+	location, err := d.Fedora.PostBinary(ctx, d.Dest, content, resp.Header.Get(headerContentType), BinaryMetadata{
+		SourceURL:             url,
+		FinalURL:              finalURL,
+		DOI:                   doi,
+		Source:                manuscript.Source,
+		RepositoryInstitution: manuscript.RepositoryInstitution,
+		Version:               manuscript.Version,
+		DownloadedAt:          time.Now(),
+		ServiceVersion:        version,
+		Filename:              filename,
+	})
+	if err != nil {
+		if limited.exceeded() {
+			return nil, errorf(CodeTooLarge, err, "content of %s exceeds the limit of %d bytes", url, d.MaxSize)
+		}
+		return nil, errorf(CodeStoreFailed, err, "could not store content of %s", url)
+	}
+
+	loggerOrDefault(d.Log).InfoContext(ctx, "stored download", "doi", doi, "url", RedactURL(url),
+		"location", location, "filename", filename)
+	d.audit(ctx, AuditEvent{Action: AuditDeposit, DOI: doi, URL: url, Location: location})
+
+	return &DownloadResult{
+		Location: location,
+		Filename: filename,
+		SHA256:   hex.EncodeToString(digest.Sum(nil)),
+	}, nil
+}
+
+// stage copies content into a temporary file in the staging area, ready to be read from the
+// beginning.  It is up to the caller to close and remove it.
+func (d DownloadService) stage(content io.Reader) (*os.File, error) {
+	staged, err := ioutil.TempFile(d.StagingDir, "download-")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = io.Copy(staged, content); err == nil {
+		_, err = staged.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		staged.Close()
+		os.Remove(staged.Name())
+		return nil, err
 	}
 
-	return d.Fedora.PostBinary(d.Dest, resp.Body, resp.Header.Get(headerContentType))
+	return staged, nil
+}
+
+func (d DownloadService) audit(ctx context.Context, event AuditEvent) {
+	if d.Audit != nil {
+		event.RequestID = RequestID(ctx)
+		if p := PrincipalFrom(ctx); p != nil {
+			event.Principal = p.Name
+		}
+		d.Audit.Record(event)
+	}
 }
 
-func (d DownloadService) verifyURL(doi string, info *DoiInfo, url string) error {
-	for _, m := range info.Manuscripts {
+// verifyURL finds the manuscript in the DOI info matching the given url, which may be its location
+// as looked up, or decoded
+func (d DownloadService) verifyURL(ctx context.Context, info *DoiInfo, url string) (*Manuscript, error) {
+	for i, m := range info.Manuscripts {
+		if m.Location == url {
+			return &info.Manuscripts[i], nil
+		}
 
 		decodedURLForPdf, err := URL.QueryUnescape(m.Location)
 		if err != nil {
-			log.Printf("file name decoding failed: %s", err)
+			loggerOrDefault(d.Log).WarnContext(ctx, "file name decoding failed", "url", m.Location, "error", err)
 		}
 
 		if decodedURLForPdf == url {
-			return nil // We found the matching URL.  Done!
+			return &info.Manuscripts[i], nil // We found the matching URL.  Done!
 		}
 	}
 
-	return ErrorBadInput("no matching URL found for DOI")
+	return nil, errorf(CodeURLNotInLookup, nil, "no matching URL found for DOI")
+}
+
+// pdfSniffLength is how far into content to look for the PDF header.  The PDF spec allows
+// for some junk before it, so it need not be at the very start.
+const pdfSniffLength = 1024
+
+// sniffPDF verifies that content starts with a PDF header, and returns a reader for the
+// entire content.
+func sniffPDF(content io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReaderSize(content, pdfSniffLength)
+
+	head, err := buffered.Peek(pdfSniffLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Contains(head, []byte("%PDF-")) {
+		return nil, errorf(CodeNotAPDF, nil, "content is not a PDF")
+	}
+
+	return buffered, nil
+}
+
+// limitReader fails with a too_large error once more than limit bytes have been read.
+// A limit of zero means no limit.
+type limitReader struct {
+	io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	l.read += int64(n)
+
+	if l.exceeded() {
+		return n, errorf(CodeTooLarge, nil, "content exceeds the limit of %d bytes", l.limit)
+	}
+
+	return n, err
+}
+
+func (l *limitReader) exceeded() bool {
+	return l.limit > 0 && l.read > l.limit
 }
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"errors"
-	"fmt"
+	"context"
+	"mime"
 	"net/http"
 )
 
 type Downloader interface {
-	Download(doi, url string) (string, error)
+	Download(ctx context.Context, doi, url string) (*DownloadResult, error)
 }
 
 func DownloadServiceHandler(svc Downloader) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeProblem(w, r, errorf(CodeMethodNotAllowed, nil, "method %s is not allowed", r.Method))
 			return
 		}
 
@@ -22,33 +22,29 @@ func DownloadServiceHandler(svc Downloader) http.Handler {
 		uri := r.URL.Query().Get("url")
 
 		if doi == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("No DOI parameter provided"))
+			writeProblem(w, r, errorf(CodeBadInput, nil, "No DOI parameter provided"))
 			return
 		}
 
 		if uri == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("No URL parameter provided"))
+			writeProblem(w, r, errorf(CodeBadInput, nil, "No URL parameter provided"))
 			return
 		}
 
-		downloadLocation, err := svc.Download(doi, uri)
+		result, err := svc.Download(r.Context(), doi, uri)
 		if err != nil {
-			var badRequest ErrorBadInput
-			if errors.As(err, &badRequest) {
-				w.WriteHeader(http.StatusBadRequest)
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-
-			fmt.Fprintf(w, "%v", err)
+			writeProblem(w, r, err)
 			return
 		}
 
 		w.Header().Add("Content-Type", "text/plain")
-		w.Header().Add("Location", downloadLocation)
+		w.Header().Add("Location", result.Location)
+		if result.Filename != "" {
+			w.Header().Add(headerContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+				"filename": result.Filename,
+			}))
+		}
 		w.WriteHeader(http.StatusCreated)
-		_, _ = w.Write([]byte(downloadLocation))
+		_, _ = w.Write([]byte(result.Location))
 	})
 }
@@ -0,0 +1,98 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+type MockDownloader func(string, string) (*pass.DownloadResult, error)
+
+func (f MockDownloader) Download(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+	return f(doi, url)
+}
+
+func TestDownloadResponse(t *testing.T) {
+	location := "http://example.org/fedora/file"
+
+	resp := httptest.NewRecorder()
+	pass.DownloadServiceHandler(MockDownloader(func(doi, url string) (*pass.DownloadResult, error) {
+		return &pass.DownloadResult{
+			Location: location,
+			Filename: "manuscript.pdf",
+		}, nil
+	})).ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/download?doi=abc/123&url=http://example.org/file.pdf", nil))
+
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("expected status created, got %d", resp.Code)
+	}
+
+	if resp.Header().Get("Location") != location || resp.Body.String() != location {
+		t.Errorf("did not get location of binary in header and body")
+	}
+
+	if resp.Header().Get("Content-Disposition") != `attachment; filename=manuscript.pdf` {
+		t.Errorf("did not get file name in Content-Disposition, got %s", resp.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestDownloadErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"url not in lookup", &pass.Error{Code: pass.CodeURLNotInLookup, Detail: "bad"}, http.StatusBadRequest, pass.CodeURLNotInLookup},
+		{"doi not found", fmt.Errorf("wrapped: %w", &pass.Error{Code: pass.CodeDOINotFound}), http.StatusNotFound, pass.CodeDOINotFound},
+		{"upstream unavailable", &pass.Error{Code: pass.CodeUpstreamUnavailable}, http.StatusServiceUnavailable, pass.CodeUpstreamUnavailable},
+		{"upstream error", &pass.Error{Code: pass.CodeUpstreamError}, http.StatusBadGateway, pass.CodeUpstreamError},
+		{"too many redirects", &pass.Error{Code: pass.CodeTooManyRedirects}, http.StatusBadGateway, pass.CodeTooManyRedirects},
+		{"store failed", &pass.Error{Code: pass.CodeStoreFailed, Err: errors.New("http://fcrepo:8080/rest is down")}, http.StatusBadGateway, pass.CodeStoreFailed},
+		{"too large", &pass.Error{Code: pass.CodeTooLarge}, http.StatusRequestEntityTooLarge, pass.CodeTooLarge},
+		{"infected", pass.ErrorInfected("Eicar-Signature"), http.StatusUnprocessableEntity, pass.CodeInfected},
+		{"uncoded", errors.New("oops"), http.StatusInternalServerError, pass.CodeInternal},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			pass.DownloadServiceHandler(MockDownloader(func(doi, url string) (*pass.DownloadResult, error) {
+				return nil, c.err
+			})).ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/download?doi=abc/123&url=http://example.org/file.pdf", nil))
+
+			if resp.Code != c.status {
+				t.Errorf("expected status %d, got %d", c.status, resp.Code)
+			}
+
+			if resp.Header().Get("Content-Type") != "application/problem+json" {
+				t.Errorf("expected problem+json, got %s", resp.Header().Get("Content-Type"))
+			}
+
+			var problem pass.Problem
+			if err := json.Unmarshal(resp.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("could not parse problem: %v", err)
+			}
+
+			if problem.Code != c.code || problem.Status != c.status {
+				t.Errorf("unexpected problem %+v", problem)
+			}
+
+			// Only client errors are detailed; the errors of others are logged
+			if c.status < 500 && problem.Detail != c.err.Error() {
+				t.Errorf("expected detail %q, got %q", c.err.Error(), problem.Detail)
+			}
+			if c.status >= 500 && (problem.Detail == "" || strings.Contains(resp.Body.String(), "fcrepo")) {
+				t.Errorf("expected a fixed detail, got %q", problem.Detail)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package main_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
@@ -18,10 +20,10 @@ func (f MockRequester) Do(req *http.Request) (*http.Response, error) {
 	return f(req)
 }
 
-type MockBinaryStore func(string, io.Reader, string) (string, error)
+type MockBinaryStore func(string, io.Reader, string, pass.BinaryMetadata) (string, error)
 
-func (f MockBinaryStore) PostBinary(url string, body io.Reader, contentType string) (string, error) {
-	return f(url, body, contentType)
+func (f MockBinaryStore) PostBinary(ctx context.Context, url string, body io.Reader, contentType string, md pass.BinaryMetadata) (string, error) {
+	return f(url, body, contentType, md)
 }
 
 func TestInputErrors(t *testing.T) {
@@ -31,7 +33,7 @@ func TestInputErrors(t *testing.T) {
 	toTest := pass.DownloadService{
 		DOIs: MockLookupService(func(doi string) (*pass.DoiInfo, error) {
 			if doi == doiDoesNotExist {
-				return nil, pass.ErrorBadInput("noDOI")
+				return nil, &pass.Error{Code: pass.CodeDOINotFound, Detail: "noDOI"}
 			}
 
 			if doi == doiHasNoURLs {
@@ -42,19 +44,23 @@ func TestInputErrors(t *testing.T) {
 		}),
 	}
 
-	cases := map[string]string{
-		"doi does not exist": doiDoesNotExist,
-		"bad URL for doi":    doiHasNoURLs,
+	cases := []struct {
+		name string
+		doi  string
+		code string
+	}{
+		{"doi does not exist", doiDoesNotExist, pass.CodeDOINotFound},
+		{"bad URL for doi", doiHasNoURLs, pass.CodeURLNotInLookup},
 	}
 
-	for name, doi := range cases {
-		doi := doi
-		t.Run(name, func(t *testing.T) {
-			_, err := toTest.Download(doi, "foo:/bar")
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			_, err := toTest.Download(context.Background(), c.doi, "foo:/bar")
 
-			var badInput pass.ErrorBadInput
-			if !errors.As(err, &badInput) {
-				t.Fatalf("expected a bad input error %s", err)
+			var coded pass.CodedError
+			if !errors.As(err, &coded) || coded.ErrorCode() != c.code {
+				t.Fatalf("expected a %s error, got %v", c.code, err)
 			}
 		})
 	}
@@ -66,6 +72,13 @@ func TestErrorFetch(t *testing.T) {
 	badConnect := "http://example.org/badConnect"
 	badErrorCode := "http://example.org/errorCode"
 
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.String(), http.StatusFound)
+	}))
+	defer redirecting.Close()
+	tooManyRedirects := redirecting.URL + "/loop"
+	client := &http.Client{CheckRedirect: pass.LimitRedirects(2)}
+
 	toTest := pass.DownloadService{
 		DOIs: MockLookupService(func(doi string) (*pass.DoiInfo, error) {
 			return &pass.DoiInfo{
@@ -81,21 +94,82 @@ func TestErrorFetch(t *testing.T) {
 				return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
 			}
 
+			if req.URL.String() == tooManyRedirects {
+				return client.Do(req)
+			}
+
 			return nil, nil
 		}),
 	}
 
-	cases := map[string]string{
-		"connection error": badConnect,
-		"bad error code":   badErrorCode,
+	cases := []struct {
+		name string
+		doi  string
+		code string
+	}{
+		{"connection error", badConnect, pass.CodeUpstreamUnavailable},
+		{"bad error code", badErrorCode, pass.CodeUpstreamError},
+		{"too many redirects", tooManyRedirects, pass.CodeTooManyRedirects},
 	}
 
-	for name, doi := range cases {
-		doi := doi
-		t.Run(name, func(t *testing.T) {
-			_, err := toTest.Download(doi, doi)
-			if err == nil {
-				t.Fatal("Should have gotten an error")
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			_, err := toTest.Download(context.Background(), c.doi, c.doi)
+
+			var coded pass.CodedError
+			if !errors.As(err, &coded) || coded.ErrorCode() != c.code {
+				t.Fatalf("Should have gotten a %s error, got %v", c.code, err)
+			}
+		})
+	}
+}
+
+func TestContentErrors(t *testing.T) {
+	location := "http://example.org/file.pdf"
+
+	cases := []struct {
+		name    string
+		content string
+		length  int64
+		store   error
+		code    string
+	}{
+		{"not a pdf", "<html>Please log in</html>", -1, nil, pass.CodeNotAPDF},
+		{"declared too large", "%PDF-1.4", 1 << 20, nil, pass.CodeTooLarge},
+		{"too large", "%PDF-1.4" + strings.Repeat(" ", 100), -1, nil, pass.CodeTooLarge},
+		{"store failed", "%PDF-1.4", -1, errors.New("fedora is down"), pass.CodeStoreFailed},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			toTest := pass.DownloadService{
+				MaxSize:    64,
+				RequirePDF: true,
+				DOIs: MockLookupService(func(doi string) (*pass.DoiInfo, error) {
+					return &pass.DoiInfo{Manuscripts: []pass.Manuscript{{Location: location}}}, nil
+				}),
+				HTTP: MockRequester(func(req *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode:    200,
+						ContentLength: c.length,
+						Body:          ioutil.NopCloser(strings.NewReader(c.content)),
+					}, nil
+				}),
+				Fedora: MockBinaryStore(func(url string, body io.Reader, mimetype string, md pass.BinaryMetadata) (string, error) {
+					if _, err := ioutil.ReadAll(body); err != nil {
+						return "", err
+					}
+					return "http://example.org/fedora/file", c.store
+				}),
+			}
+
+			_, err := toTest.Download(context.Background(), "abc/123", location)
+
+			var coded pass.CodedError
+			if !errors.As(err, &coded) || coded.ErrorCode() != c.code {
+				t.Fatalf("expected a %s error, got %v", c.code, err)
 			}
 		})
 	}
@@ -115,7 +189,12 @@ func TestPostBody(t *testing.T) {
 		DOIs: MockLookupService(func(d string) (*pass.DoiInfo, error) {
 			if d == doi {
 				return &pass.DoiInfo{
-					Manuscripts: []pass.Manuscript{{Location: location}},
+					Manuscripts: []pass.Manuscript{{
+						Location:              location,
+						Source:                "Unpaywall",
+						RepositoryInstitution: "Example",
+						Version:               "acceptedVersion",
+					}},
 				}, nil
 			}
 
@@ -136,11 +215,17 @@ func TestPostBody(t *testing.T) {
 			}
 			return nil, errors.New("oops")
 		}),
-		Fedora: MockBinaryStore(func(url string, body io.Reader, mimetype string) (string, error) {
+		Fedora: MockBinaryStore(func(url string, body io.Reader, mimetype string, md pass.BinaryMetadata) (string, error) {
 			if url != dest {
 				return "", fmt.Errorf("deposit expected into %s, instead was %s", dest, url)
 			}
 
+			if md.DOI != doi || md.SourceURL != location || md.FinalURL != location ||
+				md.Source != "Unpaywall" || md.RepositoryInstitution != "Example" ||
+				md.Version != "acceptedVersion" || md.DownloadedAt.IsZero() || md.ServiceVersion == "" {
+				return "", fmt.Errorf("unexpected binary metadata %+v", md)
+			}
+
 			if mimetype != expectedContentType {
 				return "", fmt.Errorf("expected content type %s, instead got %s", expectedContentType, mimetype)
 			}
@@ -154,13 +239,73 @@ func TestPostBody(t *testing.T) {
 		}),
 	}
 
-	url, err := toTest.Download(doi, location)
+	result, err := toTest.Download(context.Background(), doi, location)
+	if err != nil {
+		t.Fatalf("Download service errored, %v", err)
+	}
 
-	if url != fedoraURL {
-		t.Errorf("Dowmload service should have returned fedora url %s, instead it returned %s", fedoraURL, url)
+	if result.Location != fedoraURL {
+		t.Errorf("Dowmload service should have returned fedora url %s, instead it returned %s", fedoraURL, result.Location)
 	}
 
-	if err != nil {
-		t.Errorf("Download service errored, %v", err)
+	if result.Filename != "file.pdf" {
+		t.Errorf("Download service should have returned file name file.pdf, instead it returned %s", result.Filename)
+	}
+}
+
+func TestFilename(t *testing.T) {
+	location := "http://example.org/path/from%20url.pdf"
+
+	cases := []struct {
+		name        string
+		disposition string
+		lookupName  string
+		expected    string
+	}{
+		{"from content disposition", `attachment; filename="from header.pdf"`, "lookup.pdf", "from header.pdf"},
+		{"from encoded content disposition", `attachment; filename*=UTF-8''na%C3%AFve.pdf`, "lookup.pdf", "naïve.pdf"},
+		{"from lookup", "", "lookup.pdf", "lookup.pdf"},
+		{"from lookup when disposition is unusable", `attachment; filename="../.."`, "lookup.pdf", "lookup.pdf"},
+		{"from url", "inline", "", "from url.pdf"},
+		{"path removed", `attachment; filename="C:\\dir\\evil.pdf"`, "", "evil.pdf"},
+		{"unsafe characters replaced", "", "pmc4221854?pdf=render", "pmc4221854_pdf=render"},
+		{"too long", "", strings.Repeat("a", 300) + ".pdf", strings.Repeat("a", 251) + ".pdf"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var stored string
+
+			toTest := pass.DownloadService{
+				DOIs: MockLookupService(func(d string) (*pass.DoiInfo, error) {
+					return &pass.DoiInfo{
+						Manuscripts: []pass.Manuscript{{Location: location, Name: c.lookupName}},
+					}, nil
+				}),
+				HTTP: MockRequester(func(req *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: 200,
+						Body:       ioutil.NopCloser(strings.NewReader("content")),
+						Header: http.Header(map[string][]string{
+							"Content-Disposition": {c.disposition},
+						}),
+					}, nil
+				}),
+				Fedora: MockBinaryStore(func(url string, body io.Reader, mimetype string, md pass.BinaryMetadata) (string, error) {
+					stored = md.Filename
+					return "http://example.org/fedora/file", nil
+				}),
+			}
+
+			result, err := toTest.Download(context.Background(), "abc/123", "http://example.org/path/from url.pdf")
+			if err != nil {
+				t.Fatalf("Download service errored, %v", err)
+			}
+
+			if result.Filename != c.expected || stored != c.expected {
+				t.Errorf("expected file name %s, got %s (stored as %s)", c.expected, result.Filename, stored)
+			}
+		})
 	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainCleanupTimeout is how long canceled work may take to clean up (e.g. deleting partial
+// deposits, which takes up to fedoraCleanupTimeout) before the service stops waiting for it
+const drainCleanupTimeout = fedoraCleanupTimeout + 5*time.Second
+
+// Drainer lets work in flight finish when the service shuts down.  Requests are served, and
+// downloads done, under its context, which is canceled if they do not finish in time.
+type Drainer struct {
+	CleanupTimeout time.Duration // How long canceled work may take to clean up.  If zero, drainCleanupTimeout is used
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	work     sync.WaitGroup
+	running  atomic.Int64
+	draining atomic.Bool
+	log      *slog.Logger
+}
+
+// NewDrainer creates a drainer for a service that is running
+func NewDrainer(logger *slog.Logger) *Drainer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Drainer{ctx: ctx, cancel: cancel, log: loggerOrDefault(logger)}
+}
+
+// Context is the context work is done under, which is canceled if the work is not finished in time
+func (d *Drainer) Context() context.Context {
+	return d.ctx
+}
+
+// Serve sets up a server so that its requests are done under the drainer's context
+func (d *Drainer) Serve(server *http.Server) *http.Server {
+	server.BaseContext = func(net.Listener) context.Context {
+		return d.Context()
+	}
+	return server
+}
+
+// Draining determines whether the service is shutting down
+func (d *Drainer) Draining() bool {
+	return d.draining.Load()
+}
+
+// Downloader tracks the downloads of the given downloader, so that they are waited for when draining
+func (d *Drainer) Downloader(downloader Downloader) Downloader {
+	return drainedDownloader{d, downloader}
+}
+
+type drainedDownloader struct {
+	drainer    *Drainer
+	downloader Downloader
+}
+
+func (d drainedDownloader) Download(ctx context.Context, doi, url string) (*DownloadResult, error) {
+	d.drainer.work.Add(1)
+	d.drainer.running.Add(1)
+	defer d.drainer.work.Done()
+	defer d.drainer.running.Add(-1)
+
+	return d.downloader.Download(ctx, doi, url)
+}
+
+// Drain shuts the service down.  It is first marked as draining (and so not ready), then after the
+// given delay, for load balancers to notice, the servers stop accepting requests.  A signal on
+// interrupt (e.g. a second SIGTERM) ends the delay early.  Requests and downloads in flight are
+// given until the timeout to finish; any that have not are canceled, and waited for while they
+// clean up, for at most CleanupTimeout.
+func (d *Drainer) Drain(delay, timeout time.Duration, interrupt <-chan os.Signal, servers ...*http.Server) error {
+	d.draining.Store(true)
+
+	d.log.Info("draining", "delay", delay, "timeout", timeout)
+	wait := time.NewTimer(delay)
+	select {
+	case <-wait.C:
+	case <-interrupt:
+		wait.Stop()
+		d.log.Info("interrupted, so draining without delay")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var shutdown sync.WaitGroup
+	for _, server := range servers {
+		shutdown.Add(1)
+		go func(server *http.Server) {
+			defer shutdown.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				_ = server.Close()
+			}
+		}(server)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		shutdown.Wait()
+		d.work.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	canceled := d.running.Load()
+	d.log.Warn("drain timed out, so canceling work in flight", "downloads", canceled)
+	d.cancel()
+
+	cleanup := d.CleanupTimeout
+	if cleanup <= 0 {
+		cleanup = drainCleanupTimeout
+	}
+
+	wait = time.NewTimer(cleanup)
+	defer wait.Stop()
+
+	select {
+	case <-finished:
+	case <-wait.C:
+		return fmt.Errorf("drain timed out after %v, and %d downloads were canceled, of which %d did not finish cleaning up within %v",
+			timeout, canceled, d.running.Load(), cleanup)
+	}
+
+	return fmt.Errorf("drain timed out after %v, and %d downloads were canceled", timeout, canceled)
+}
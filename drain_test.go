@@ -0,0 +1,188 @@
+package main_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+type downloaderFunc func(ctx context.Context, doi, url string) (*pass.DownloadResult, error)
+
+func (f downloaderFunc) Download(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+	return f(ctx, doi, url)
+}
+
+// drainedServer serves downloads by the given downloader, under the drainer
+func drainedServer(t *testing.T, drainer *pass.Drainer, downloader pass.Downloader) *httptest.Server {
+	server := httptest.NewUnstartedServer(pass.DownloadServiceHandler(drainer.Downloader(downloader)))
+	drainer.Serve(server.Config)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startDownload POSTs a download, returning a channel of its response status
+func startDownload(server *httptest.Server) <-chan int {
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(server.URL+"?doi=10.1/a&url=http://example.org/a.pdf", "text/plain", nil)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	return status
+}
+
+func TestDrainWaitsForDownloads(t *testing.T) {
+	drainer := pass.NewDrainer(nil)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	server := drainedServer(t, drainer, downloaderFunc(func(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+		close(started)
+		<-release
+		return &pass.DownloadResult{Location: "http://example.org/fedora/a"}, nil
+	}))
+
+	status := startDownload(server)
+	<-started
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drainer.Drain(0, 5*time.Second, nil, server.Config)
+	}()
+
+	readiness := &pass.Readiness{Drainer: drainer}
+	for !readiness.Report().Draining {
+		time.Sleep(time.Millisecond)
+	}
+	if readiness.Report().Ready {
+		t.Errorf("expected the service not to be ready while draining")
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("drain should wait for the download in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-drained; err != nil {
+		t.Errorf("expected the drain to finish, got %v", err)
+	}
+	if code := <-status; code != http.StatusCreated {
+		t.Errorf("expected the download to finish, got status %d", code)
+	}
+}
+
+func TestDrainCancelsDownloads(t *testing.T) {
+	drainer := pass.NewDrainer(nil)
+	started := make(chan struct{})
+	var cleanedUp int32
+
+	server := drainedServer(t, drainer, downloaderFunc(func(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond) // e.g. rolling back a Fedora transaction
+		atomic.StoreInt32(&cleanedUp, 1)
+		return nil, ctx.Err()
+	}))
+
+	status := startDownload(server)
+	<-started
+
+	if err := drainer.Drain(0, 50*time.Millisecond, nil, server.Config); err == nil {
+		t.Errorf("expected an error, since the download was canceled")
+	}
+
+	if atomic.LoadInt32(&cleanedUp) != 1 {
+		t.Errorf("expected the drain to wait for the canceled download to clean up")
+	}
+	<-status
+}
+
+func TestDrainIdle(t *testing.T) {
+	drainer := pass.NewDrainer(nil)
+	server := drainedServer(t, drainer, downloaderFunc(func(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+		return &pass.DownloadResult{}, nil
+	}))
+
+	if err := drainer.Drain(0, time.Second, nil, server.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	if drainer.Context().Err() == nil {
+		t.Errorf("expected the drainer's context to be done")
+	}
+
+	if _, err := http.Post(server.URL, "text/plain", nil); err == nil {
+		t.Errorf("expected requests to be refused after draining")
+	}
+}
+
+func TestDrainCleanupTimeout(t *testing.T) {
+	drainer := pass.NewDrainer(nil)
+	drainer.CleanupTimeout = 10 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	// A download that does not stop when canceled
+	server := drainedServer(t, drainer, downloaderFunc(func(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+		close(started)
+		<-release
+		return nil, ctx.Err()
+	}))
+
+	startDownload(server)
+	<-started
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drainer.Drain(0, 10*time.Millisecond, nil, server.Config)
+	}()
+
+	select {
+	case err := <-drained:
+		if err == nil {
+			t.Errorf("expected an error, since the download did not finish")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain should not wait for canceled work forever")
+	}
+}
+
+func TestDrainInterrupted(t *testing.T) {
+	drainer := pass.NewDrainer(nil)
+	server := drainedServer(t, drainer, downloaderFunc(func(ctx context.Context, doi, url string) (*pass.DownloadResult, error) {
+		return &pass.DownloadResult{}, nil
+	}))
+
+	interrupt := make(chan os.Signal, 1)
+	interrupt <- os.Interrupt
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drainer.Drain(time.Hour, time.Second, interrupt, server.Config)
+	}()
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("expected the drain to finish, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a second signal should end the delay")
+	}
+}
@@ -1,9 +1,164 @@
 package main
 
-// ErrorBadInput is thrown whenever input data is bad in some way
-// (incomplete, formatted incorrectly, corrupt, etc)
-type ErrorBadInput string
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
 
-func (e ErrorBadInput) Error() string {
-	return string(e)
+// Error codes.  These are stable, so clients may rely on them to distinguish errors.
+const (
+	CodeBadInput            = "bad_input"            // A request parameter is missing or malformed
+	CodeMethodNotAllowed    = "method_not_allowed"   // The HTTP method is not supported
+	CodeUnauthorized        = "unauthorized"         // The request lacks valid credentials
+	CodeNotCached           = "not_cached"           // The DOI has no cached lookup
+	CodeDOINotFound         = "doi_not_found"        // The DOI is not known
+	CodeInvalidDOI          = "invalid_doi"          // The DOI is not a valid DOI
+	CodeURLNotInLookup      = "url_not_in_lookup"    // The URL is not a manuscript found by looking up the DOI
+	CodeUpstreamUnavailable = "upstream_unavailable" // A remote service or host could not be reached, or is temporarily unavailable
+	CodeUpstreamError       = "upstream_error"       // A remote service or host answered with an error, or an unusable response
+	CodeTooManyRedirects    = "too_many_redirects"   // The download URL redirected more times than allowed
+	CodeNotAPDF             = "not_a_pdf"            // The downloaded content is not a PDF
+	CodeTooLarge            = "too_large"            // The downloaded content exceeds the maximum size
+	CodeInfected            = "infected"             // The downloaded content contains malware
+	CodeStoreFailed         = "store_failed"         // The content could not be stored in Fedora
+	CodeInternal            = "internal_error"       // Anything else
+)
+
+// codeStatus is the HTTP status for each error code
+var codeStatus = map[string]int{
+	CodeBadInput:            http.StatusBadRequest,
+	CodeMethodNotAllowed:    http.StatusMethodNotAllowed,
+	CodeUnauthorized:        http.StatusUnauthorized,
+	CodeNotCached:           http.StatusNotFound,
+	CodeDOINotFound:         http.StatusNotFound,
+	CodeInvalidDOI:          http.StatusBadRequest,
+	CodeURLNotInLookup:      http.StatusBadRequest,
+	CodeUpstreamUnavailable: http.StatusServiceUnavailable,
+	CodeUpstreamError:       http.StatusBadGateway,
+	CodeTooManyRedirects:    http.StatusBadGateway,
+	CodeNotAPDF:             http.StatusUnprocessableEntity,
+	CodeTooLarge:            http.StatusRequestEntityTooLarge,
+	CodeInfected:            http.StatusUnprocessableEntity,
+	CodeStoreFailed:         http.StatusBadGateway,
+	CodeInternal:            http.StatusInternalServerError,
+}
+
+// CodedError is an error with a stable, machine-readable code and a corresponding HTTP status.
+type CodedError interface {
+	error
+	ErrorCode() string
+	HTTPStatus() int
+}
+
+// Error is a CodedError with a human-readable detail message, and an optional underlying cause
+type Error struct {
+	Code   string // One of the Code* constants
+	Detail string // Human-readable description of the error
+	Err    error  // Underlying cause, if any
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Detail, e.Err)
+	}
+	return e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode is the stable code of the error
+func (e *Error) ErrorCode() string {
+	return e.Code
+}
+
+// HTTPStatus is the HTTP status corresponding to the error code
+func (e *Error) HTTPStatus() int {
+	if status, ok := codeStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// errorf creates an Error with the given code and cause, and a formatted detail message
+func errorf(code string, cause error, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:   code,
+		Detail: fmt.Sprintf(format, args...),
+		Err:    cause,
+	}
+}
+
+// Problem is an RFC 7807 problem details response, with a stable error code
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// ErrorReport is the code and detail of an error, for reporting it as part of a larger result
+type ErrorReport struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// reportError reports an error, or returns nil if there is none.  Errors without a code are
+// internal errors.
+func reportError(err error) *ErrorReport {
+	if err == nil {
+		return nil
+	}
+
+	report := &ErrorReport{Code: CodeInternal, Detail: err.Error()}
+
+	var coded CodedError
+	if errors.As(err, &coded) {
+		report.Code = coded.ErrorCode()
+	}
+	return report
+}
+
+const contentTypeProblem = "application/problem+json"
+
+// serverErrorDetail is the detail of problems with a 5xx status.  Their errors may include
+// internal URLs and the responses of Fedora or other hosts, so they are logged, not returned.
+const serverErrorDetail = "the request could not be completed; the error is logged with the request ID"
+
+// writeProblem writes an error as an application/problem+json response.  Errors without
+// a code are internal errors.
+func writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	code, status := CodeInternal, http.StatusInternalServerError
+
+	var coded CodedError
+	if errors.As(err, &coded) {
+		code, status = coded.ErrorCode(), coded.HTTPStatus()
+	}
+
+	detail := err.Error()
+	if status >= 500 {
+		slog.ErrorContext(r.Context(), "request failed", "code", code, "error", err)
+		detail = serverErrorDetail
+	}
+
+	w.Header().Set(headerContentType, contentTypeProblem)
+	w.WriteHeader(status)
+
+	err = json.NewEncoder(w).Encode(Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		RequestID: RequestID(r.Context()),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error encoding JSON response", "error", err)
+	}
 }
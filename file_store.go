@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LocalFileStore stores binaries in local files, rather than in Fedora, e.g. for trying out
+// downloads from the command line.  Existing files are never overwritten.
+type LocalFileStore struct{}
+
+// PostBinary implements BinaryStore.  If path is a directory, the binary is stored in it with
+// its file name, numbered if a file of that name already exists.  The path of the stored file
+// is returned.
+func (LocalFileStore) PostBinary(ctx context.Context, path string, body io.Reader, contentType string, md BinaryMetadata) (string, error) {
+	dir, name, numbered := filepath.Dir(path), filepath.Base(path), false
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		dir, name, numbered = path, filepath.Base(md.Filename), true
+		if name == "." || name == string(filepath.Separator) {
+			name = "manuscript"
+		}
+	} else if err == nil {
+		return "", errorf(CodeStoreFailed, nil, "file %s already exists", path)
+	}
+
+	// Write to a temporary file first, so that a failed download leaves nothing behind
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return "", errorf(CodeStoreFailed, err, "could not create file in %s", dir)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "could not write %s", filepath.Join(dir, name))
+	}
+
+	// The file is linked to its name, which fails if the name is taken, even by a concurrent
+	// download, so that it is never overwritten
+	ext := filepath.Ext(name)
+	path = filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		err = os.Link(tmp.Name(), path)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return "", errorf(CodeStoreFailed, err, "could not write %s", path)
+		}
+		if !numbered {
+			return "", errorf(CodeStoreFailed, nil, "file %s already exists", path)
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+
+	return filepath.Abs(path)
+}
@@ -0,0 +1,108 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func TestLocalFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store := pass.LocalFileStore{}
+
+	// Stored in a directory, with its file name
+	path, err := store.PostBinary(context.Background(), dir, strings.NewReader("one"), "application/pdf",
+		pass.BinaryMetadata{Filename: "file.pdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "file.pdf") {
+		t.Errorf("unexpected path %s", path)
+	}
+
+	// Stored in a given file
+	named := filepath.Join(dir, "named.pdf")
+	if path, err = store.PostBinary(context.Background(), named, strings.NewReader("two"), "application/pdf",
+		pass.BinaryMetadata{Filename: "file.pdf"}); err != nil || path != named {
+		t.Fatalf("unexpected path %s, %v", path, err)
+	}
+
+	// Never overwritten
+	if _, err = store.PostBinary(context.Background(), named, strings.NewReader("three"), "application/pdf",
+		pass.BinaryMetadata{Filename: "file.pdf"}); err == nil {
+		t.Errorf("expected existing file not to be overwritten")
+	}
+
+	// ... but numbered, in a directory
+	if path, err = store.PostBinary(context.Background(), dir, strings.NewReader("four"), "application/pdf",
+		pass.BinaryMetadata{Filename: "file.pdf"}); err != nil || path != filepath.Join(dir, "file-1.pdf") {
+		t.Errorf("unexpected path %s, %v", path, err)
+	}
+
+	for file, content := range map[string]string{"file.pdf": "one", "named.pdf": "two", "file-1.pdf": "four"} {
+		if stored, _ := os.ReadFile(filepath.Join(dir, file)); string(stored) != content {
+			t.Errorf("expected %s to contain %q, got %q", file, content, stored)
+		}
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Errorf("expected no temporary files to be left behind, got %v", entries)
+	}
+}
+
+func TestLocalFileStoreConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	store := pass.LocalFileStore{}
+
+	const downloads = 20
+	var wg, started sync.WaitGroup
+	started.Add(downloads)
+	paths := make([]string, downloads)
+	for i := 0; i < downloads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := &barrierReader{Reader: strings.NewReader(fmt.Sprint(i)), started: &started}
+			path, err := store.PostBinary(context.Background(), dir, body, "application/pdf",
+				pass.BinaryMetadata{Filename: "file.pdf"})
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = path
+		}(i)
+	}
+	wg.Wait()
+
+	// Every download has a file of its own
+	for i, path := range paths {
+		if stored, _ := os.ReadFile(path); string(stored) != fmt.Sprint(i) {
+			t.Errorf("expected %s to contain %d, got %q", path, i, stored)
+		}
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != downloads {
+		t.Errorf("expected %d files, got %d", downloads, len(entries))
+	}
+}
+
+// barrierReader reads its content only once every reader sharing the wait group has started to
+type barrierReader struct {
+	io.Reader
+	started *sync.WaitGroup
+	once    sync.Once
+}
+
+func (b *barrierReader) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		b.started.Done()
+		b.started.Wait()
+	})
+	return b.Reader.Read(p)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	URL "net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilenameLength is the maximum length of a file name, in bytes
+const maxFilenameLength = 255
+
+// bestFilename determines the file name of downloaded content.  In order of preference,
+// it comes from the Content-Disposition header of the response, the name in the
+// manuscript lookup result, or the last segment of the URL path.  The first
+// candidate that is non-empty after sanitization wins.
+func bestFilename(resp *http.Response, manuscript *Manuscript, url string) string {
+	var candidates []string
+
+	if resp != nil {
+		if _, params, err := mime.ParseMediaType(resp.Header.Get(headerContentDisposition)); err == nil {
+			candidates = append(candidates, params["filename"])
+		}
+	}
+
+	if manuscript != nil {
+		candidates = append(candidates, manuscript.Name)
+	}
+
+	if u, err := URL.Parse(url); err == nil {
+		candidates = append(candidates, path.Base(u.Path))
+	}
+
+	for _, candidate := range candidates {
+		if name := sanitizeFilename(candidate); name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// sanitizeFilename makes a file name safe for storing and serving.  Any directory
+// components are removed, characters that are not safe in file names are replaced with
+// underscores, and the result is trimmed and truncated.
+func sanitizeFilename(name string) string {
+
+	// Remove any path, using either kind of separator
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || strings.ContainsRune(`:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.Trim(name, " .")
+
+	for len(name) > maxFilenameLength {
+		ext := path.Ext(name)
+		if len(ext) >= maxFilenameLength/2 {
+			ext = ""
+		}
+		_, size := utf8.DecodeLastRuneInString(name[:len(name)-len(ext)])
+		name = name[:len(name)-len(ext)-size] + ext
+	}
+
+	return name
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	readinessDefaultTTL     = 5 * time.Second
+	readinessDefaultTimeout = 5 * time.Second
+)
+
+// Check is a named check of whether a dependency is available.  Its context is canceled if the
+// check takes too long.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Readiness determines whether the service is ready to handle requests, by checking its
+// dependencies.  Results are cached briefly, so that frequent probes do not hammer them, and
+// concurrent probes wait for the same checks.
+type Readiness struct {
+	Checks  []Check
+	TTL     time.Duration // How long results are cached.
+	Timeout time.Duration // How long to wait for any one check to complete.
+	Warming *CacheWarmer  // Cache warming, whose progress is reported.  Can be nil
+	Drainer *Drainer      // While it is draining, the service is not ready.  Can be nil
+
+	m          sync.Mutex
+	report     *ReadinessReport
+	checkedAt  time.Time
+	refreshing chan struct{} // Closed when the checks in flight finish, or nil if there are none
+}
+
+// ReadinessReport describes the status of each dependency
+type ReadinessReport struct {
+	Ready        bool               `json:"ready"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+	Warming      *WarmingProgress   `json:"warming,omitempty"` // Does not affect readiness
+	Draining     bool               `json:"draining,omitempty"`
+}
+
+// DependencyStatus describes the result of checking a single dependency
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report checks all dependencies, or uses the cached results if they are recent enough.  Cache
+// warming progress, and whether the service is draining, are always current.
+func (r *Readiness) Report() *ReadinessReport {
+	report := *r.check()
+	if r.Warming != nil {
+		progress := r.Warming.Progress()
+		report.Warming = &progress
+	}
+	if r.Drainer != nil && r.Drainer.Draining() {
+		report.Ready = false
+		report.Draining = true
+	}
+	return &report
+}
+
+// check returns the cached results if they are recent enough.  Otherwise, it runs the checks, or
+// waits for the checks already in flight.  The lock is not held while they run.
+func (r *Readiness) check() *ReadinessReport {
+	ttl := r.TTL
+	if ttl <= 0 {
+		ttl = readinessDefaultTTL
+	}
+
+	r.m.Lock()
+	if r.report != nil && time.Since(r.checkedAt) < ttl {
+		defer r.m.Unlock()
+		return r.report
+	}
+
+	if refreshing := r.refreshing; refreshing != nil {
+		r.m.Unlock()
+		<-refreshing
+
+		r.m.Lock()
+		defer r.m.Unlock()
+		return r.report
+	}
+
+	refreshing := make(chan struct{})
+	r.refreshing = refreshing
+	r.m.Unlock()
+
+	report := r.checkAll()
+
+	r.m.Lock()
+	r.report, r.checkedAt, r.refreshing = report, time.Now(), nil
+	r.m.Unlock()
+	close(refreshing)
+
+	return report
+}
+
+// checkAll runs every check concurrently
+func (r *Readiness) checkAll() *ReadinessReport {
+	report := &ReadinessReport{
+		Ready:        true,
+		Dependencies: make([]DependencyStatus, len(r.Checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, check := range r.Checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			report.Dependencies[i] = r.run(check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, status := range report.Dependencies {
+		report.Ready = report.Ready && status.OK
+	}
+
+	return report
+}
+
+func (r *Readiness) run(check Check) DependencyStatus {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = readinessDefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The check is abandoned if it does not return in time, even if it ignores its context
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- check.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+
+	status := DependencyStatus{
+		Name:      check.Name,
+		OK:        err == nil,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+// LivenessHandler reports that the service is alive, as long as it can serve requests at all
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json;charset=utf-8")
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	})
+}
+
+// ReadinessHandler reports the status of each dependency as JSON.  The response code is
+// 503 if any dependency is not available.
+func ReadinessHandler(readiness *Readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := readiness.Report()
+
+		w.Header().Add("Content-Type", "application/json;charset=utf-8")
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			slog.ErrorContext(r.Context(), "error encoding JSON response", "error", err)
+		}
+	})
+}
+
+// CheckAccess verifies that Fedora is up, and accepts our credentials
+func (c *InternalPassClient) CheckAccess(ctx context.Context) error {
+	_, err := c.head(ctx, c.InternalBaseURI)
+	return err
+}
+
+// CheckWritable verifies that the given container exists, and accepts POSTs
+func (c *InternalPassClient) CheckWritable(ctx context.Context, container string) error {
+	resp, err := c.head(ctx, container)
+	if err != nil {
+		return err
+	}
+
+	for _, allow := range resp.Header.Values("Allow") {
+		for _, method := range strings.Split(allow, ",") {
+			if strings.TrimSpace(method) == http.MethodPost {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("container %s does not allow POST", container)
+}
+
+func (c *InternalPassClient) head(ctx context.Context, url string) (*http.Response, error) {
+	request, err := c.newRequest(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.exec("", request)
+}
+
+// Ping verifies that the unpaywall API answers requests
+func (u UnpaywallService) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.Baseuri, nil)
+	if err != nil {
+		return fmt.Errorf("could not form unpaywall API request: %w", err)
+	}
+
+	resp, err := u.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("unpaywall request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unpaywall request failed with code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func TestLiveness(t *testing.T) {
+	resp := httptest.NewRecorder()
+	pass.LivenessHandler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if resp.Code != http.StatusOK {
+		t.Errorf("expected OK, got %d", resp.Code)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	var unpaywallUp int32 = 1
+	var unpaywallCalls int32
+
+	fedora := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "fedoraAdmin" || pass != "moo" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/rest":
+			w.WriteHeader(http.StatusOK)
+		case "/rest/files":
+			w.Header().Add("Allow", "GET,HEAD,POST,PUT")
+			w.WriteHeader(http.StatusOK)
+		case "/rest/readonly":
+			w.Header().Add("Allow", "GET,HEAD")
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer fedora.Close()
+
+	unpaywall := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&unpaywallCalls, 1)
+		if atomic.LoadInt32(&unpaywallUp) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer unpaywall.Close()
+
+	client := pass.InternalPassClient{
+		Requester:       fedora.Client(),
+		InternalBaseURI: fedora.URL + "/rest",
+		Credentials:     &pass.Credentials{Username: "fedoraAdmin", Password: "moo"},
+	}
+
+	badCredentials := client
+	badCredentials.Credentials = &pass.Credentials{Username: "fedoraAdmin", Password: "wrong"}
+
+	unpaywallService := pass.UnpaywallService{
+		HTTP:    unpaywall.Client(),
+		Baseuri: unpaywall.URL,
+	}
+
+	readiness := func(checks ...pass.Check) *pass.ReadinessReport {
+		resp := httptest.NewRecorder()
+		pass.ReadinessHandler(&pass.Readiness{Checks: checks}).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var report pass.ReadinessReport
+		if err := json.Unmarshal(resp.Body.Bytes(), &report); err != nil {
+			t.Fatalf("could not parse readiness response: %v", err)
+		}
+
+		if report.Ready != (resp.Code == http.StatusOK) {
+			t.Errorf("response code %d does not agree with readiness %t", resp.Code, report.Ready)
+		}
+
+		return &report
+	}
+
+	report := readiness(
+		pass.Check{Name: "fedora", Check: client.CheckAccess},
+		pass.Check{Name: "dest", Check: func(ctx context.Context) error { return client.CheckWritable(ctx, fedora.URL+"/rest/files") }},
+		pass.Check{Name: "unpaywall", Check: unpaywallService.Ping},
+	)
+	if !report.Ready || len(report.Dependencies) != 3 {
+		t.Errorf("expected to be ready, got %+v", report)
+	}
+
+	cases := map[string]pass.Check{
+		"bad credentials":      {Name: "fedora", Check: badCredentials.CheckAccess},
+		"dest does not exist":  {Name: "dest", Check: func(ctx context.Context) error { return client.CheckWritable(ctx, fedora.URL+"/rest/nope") }},
+		"dest is not writable": {Name: "dest", Check: func(ctx context.Context) error { return client.CheckWritable(ctx, fedora.URL+"/rest/readonly") }},
+	}
+
+	for name, check := range cases {
+		check := check
+		t.Run(name, func(t *testing.T) {
+			report := readiness(check)
+			if report.Ready || report.Dependencies[0].OK || report.Dependencies[0].Error == "" {
+				t.Errorf("expected not to be ready, with an error, got %+v", report)
+			}
+		})
+	}
+
+	// Results are cached, so unpaywall going down won't be noticed right away
+	cached := &pass.Readiness{Checks: []pass.Check{{Name: "unpaywall", Check: unpaywallService.Ping}}}
+	atomic.StoreInt32(&unpaywallCalls, 0)
+
+	if !cached.Report().Ready {
+		t.Fatalf("expected unpaywall to be up")
+	}
+
+	atomic.StoreInt32(&unpaywallUp, 0)
+
+	if !cached.Report().Ready || atomic.LoadInt32(&unpaywallCalls) != 1 {
+		t.Errorf("expected cached readiness report")
+	}
+}
+
+func TestReadinessHungCheck(t *testing.T) {
+	var calls, stopped int32
+	readiness := &pass.Readiness{
+		Timeout: 20 * time.Millisecond,
+		Checks: []pass.Check{{Name: "fedora", Check: func(ctx context.Context) error {
+			atomic.AddInt32(&calls, 1)
+			<-ctx.Done()
+			atomic.AddInt32(&stopped, 1)
+			return ctx.Err()
+		}}},
+	}
+
+	// Concurrent probes wait for the same check, rather than each running it in turn
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report := readiness.Report()
+			if report.Ready || !strings.Contains(report.Dependencies[0].Error, "timed out") {
+				t.Errorf("expected the check to time out, got %+v", report.Dependencies)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single check, got %d", n)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&stopped) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&stopped) != 1 {
+		t.Errorf("expected the timed out check to be canceled")
+	}
+}
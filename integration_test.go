@@ -1,12 +1,17 @@
+//go:build integration
+// +build integration
+
 package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,6 +54,49 @@ func TestIntegration(t *testing.T) {
 	}
 }
 
+func TestTransactionalStore(t *testing.T) {
+	fcrepo6 := "http://localhost:8081/fcrepo/rest"
+	source := "http://example.org/manuscript.pdf"
+
+	client := &TransactionalPassClient{
+		InternalPassClient: InternalPassClient{
+			Requester:       httpClient,
+			Credentials:     &Credentials{Username: "fedoraAdmin", Password: "fedoraAdmin"},
+			InternalBaseURI: fcrepo6,
+			ExternalBaseURI: fcrepo6,
+		},
+	}
+
+	binaryURI, err := client.PostBinary(context.Background(), fcrepo6, strings.NewReader("manuscript"), "text/plain", BinaryMetadata{
+		SourceURL: source,
+		DOI:       "10.1038/nature12373",
+	})
+	if err != nil {
+		t.Fatalf("could not post binary: %v", err)
+	}
+
+	// The binary and its description should both be visible outside the transaction
+	request, _ := http.NewRequest(http.MethodGet, binaryURI+"/fcr:metadata", nil)
+	request.SetBasicAuth("fedoraAdmin", "fedoraAdmin")
+	request.Header.Set("Accept", "application/n-triples")
+	resp, err := mustSucceed(httpClient.Do(request))
+	if err != nil {
+		t.Fatalf("GET of binary description failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	description, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(description), "<"+source+">") {
+		t.Fatalf("binary description does not contain source URL:\n%s", description)
+	}
+
+	// Posting into a container that does not exist fails, and is rolled back
+	_, err = client.PostBinary(context.Background(), fcrepo6+"/does/not/exist", strings.NewReader("manuscript"), "text/plain", BinaryMetadata{})
+	if err == nil {
+		t.Fatalf("expected posting into a nonexistent container to fail")
+	}
+}
+
 func lookupDOI(t *testing.T, url string) *DoiInfo {
 	resp, err := mustSucceed(httpClient.Get(url))
 	if err != nil {
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	URL "net/url"
+	"strings"
+	"time"
+)
+
+const headerRequestID = "X-Request-ID"
+
+// maxRequestIDLength is the longest incoming request ID that will be accepted
+const maxRequestIDLength = 128
+
+// redactedParams are query parameters whose values are removed from logged URLs
+var redactedParams = []string{"email", "password", "token", "key", "apikey", "api_key", "secret"}
+
+type requestIDKey struct{}
+
+// NewLogger creates a structured logger at the given level ("debug", "info", "warn", or
+// "error"), in the given format ("json" or "text").  Records logged with a context
+// include its request ID and principal, if any.
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: errorString}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+// errorString replaces errors in log records with their messages.  The text handler would
+// otherwise format them with %+v, which prints the stack traces of pkg/errors errors.
+func errorString(_ []string, attr slog.Attr) slog.Attr {
+	if err, ok := attr.Value.Any().(error); ok {
+		attr.Value = slog.StringValue(err.Error())
+	}
+	return attr
+}
+
+// contextHandler adds the request ID and principal from the context to every log record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if p := PrincipalFrom(ctx); p != nil && p.Name != "" {
+		r.AddAttrs(slog.String("principal", p.Name))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// loggerOrDefault returns the given logger, or the default logger if nil
+func loggerOrDefault(log *slog.Logger) *slog.Logger {
+	if log == nil {
+		return slog.Default()
+	}
+	return log
+}
+
+// WithRequestID returns a context carrying the given request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDHandler assigns each request an ID, taken from its X-Request-ID header or
+// generated if absent or unusable.  The ID is stored in the request context, and returned
+// in the X-Request-ID response header.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(headerRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(headerRequestID, id)
+		h.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// AccessLogHandler logs each request once it has been served
+func AccessLogHandler(log *slog.Logger, h http.Handler) http.Handler {
+	log = loggerOrDefault(log)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		h.ServeHTTP(recorder, r)
+
+		log.InfoContext(r.Context(), "served request",
+			"method", r.Method,
+			"url", RedactURL(r.URL.String()),
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote", r.RemoteAddr)
+	})
+}
+
+// LogRequests logs outbound requests made by the given requester, and forwards the
+// request ID from each request's context in its X-Request-ID header.  URLs in errors
+// are redacted.
+func LogRequests(log *slog.Logger, r Requester) Requester {
+	return loggingRequester{
+		Requester: r,
+		log:       loggerOrDefault(log),
+	}
+}
+
+type loggingRequester struct {
+	Requester
+	log *slog.Logger
+}
+
+func (l loggingRequester) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(headerRequestID, id)
+	}
+
+	start := time.Now()
+	resp, err := l.Requester.Do(req)
+
+	attrs := []any{
+		"method", req.Method,
+		"url", RedactURL(req.URL.String()),
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+
+	if err != nil {
+		var urlErr *URL.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = RedactURL(urlErr.URL)
+		}
+		l.log.WarnContext(ctx, "outbound request failed", append(attrs, "error", err)...)
+		return resp, err
+	}
+
+	l.log.DebugContext(ctx, "outbound request", append(attrs, "status", resp.StatusCode)...)
+	return resp, nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush flushes the underlying ResponseWriter, if it can be
+func (s *statusRecorder) Flush() {
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter, so that an http.ResponseController can reach
+// the features it supports, such as hijacking
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// RedactURL removes passwords and sensitive query parameters (such as email) from a URL,
+// so that it is safe to log.
+func RedactURL(url string) string {
+	u, err := URL.Parse(url)
+	if err != nil {
+		return "<unparseable url>"
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = URL.UserPassword(u.User.Username(), "REDACTED")
+	}
+
+	query := u.Query()
+	redacted := false
+	for param := range query {
+		for _, sensitive := range redactedParams {
+			if strings.EqualFold(param, sensitive) {
+				query.Set(param, "REDACTED")
+				redacted = true
+			}
+		}
+	}
+
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		if r <= 0x20 || r >= 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Output formats of the lookup command
+const (
+	FormatJSON  = "json"
+	FormatTable = "table"
+	FormatCSV   = "csv"
+)
+
+// lookupCommand looks up DOIs directly, without a running service.  Lookups are not cached.
+func lookupCommand() *cli.Command {
+	var opts serveOpts
+	var format string
+
+	return withConfigFile(&cli.Command{
+		Name:      "lookup",
+		Usage:     "Look up DOIs in Unpaywall, and print their manuscripts",
+		ArgsUsage: "DOI... (- reads DOIs from stdin, one per line)",
+		Flags: concatFlags(unpaywallFlags(&opts), outboundFlags(&opts), logFlags(&opts), []cli.Flag{
+			maxRedirectsFlag(&opts),
+			&cli.StringFlag{
+				Name:        "format",
+				Aliases:     []string{"f"},
+				Usage:       "Output format: json, table, or csv",
+				Destination: &format,
+				Value:       FormatJSON,
+			},
+		}),
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				return fmt.Errorf("expected at least one DOI, or - to read DOIs from stdin")
+			}
+
+			if err := opts.validate(checkUnpaywall, checkRedirects, checkLog, checkOutbound); err != nil {
+				return err
+			}
+
+			logger, err := NewLogger(c.App.ErrWriter, opts.logLevel, opts.logFormat)
+			if err != nil {
+				return err
+			}
+
+			out, err := NewLookupWriter(c.App.Writer, format)
+			if err != nil {
+				return err
+			}
+
+			var dois []string
+			for _, arg := range c.Args().Slice() {
+				if arg != "-" {
+					dois = append(dois, trimDOI(arg))
+					continue
+				}
+
+				stdin, err := readDOIs(os.Stdin)
+				if err != nil {
+					return fmt.Errorf("could not read DOIs from stdin: %w", err)
+				}
+				dois = append(dois, stdin...)
+			}
+
+			rootCAs, err := opts.rootCAs()
+			if err != nil {
+				return err
+			}
+
+			unpaywall := UnpaywallService{
+				HTTP:    LogRequests(logger, newHTTPClient(opts.maxredirects, rootCAs)),
+				Baseuri: opts.unpaywallBaseURI,
+				Email:   opts.unpaywallEmail,
+				Log:     logger,
+			}
+
+			failed, err := LookupAll(c.Context, unpaywall, dois, out)
+			if err != nil {
+				return err
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d lookups failed", failed, len(dois))
+			}
+			return nil
+		},
+	})
+}
+
+// LookupResult is the result of looking up a DOI: either its info, or an error
+type LookupResult struct {
+	DOI string `json:"doi"`
+	*DoiInfo
+	Error *ErrorReport `json:"error,omitempty"`
+}
+
+// LookupWriter writes lookup results in some format
+type LookupWriter interface {
+	Write(result LookupResult) error
+	Close() error // Finishes the output, but does not close the underlying writer
+}
+
+// NewLookupWriter creates a writer for the given output format
+func NewLookupWriter(w io.Writer, format string) (LookupWriter, error) {
+	switch format {
+	case FormatJSON:
+		return &jsonLookupWriter{w: w}, nil
+	case FormatTable:
+		out := &tableLookupWriter{w: tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)}
+		_, err := fmt.Fprintln(out.w, "DOI\tVERSION\tREPOSITORY\tURL")
+		return out, err
+	case FormatCSV:
+		out := &csvLookupWriter{w: csv.NewWriter(w)}
+		return out, out.w.Write([]string{"doi", "version", "repository", "name", "type", "source", "url", "error"})
+	default:
+		return nil, fmt.Errorf("unknown output format %q, expected json, table, or csv", format)
+	}
+}
+
+// LookupAll looks up each DOI in turn, and writes its result.  It returns how many lookups
+// failed, or an error if the results could not be written.
+func LookupAll(ctx context.Context, svc LookupService, dois []string, out LookupWriter) (int, error) {
+	failed := 0
+	for _, doi := range dois {
+		info, err := svc.Lookup(ctx, doi)
+		if err != nil {
+			failed++
+		}
+
+		if err := out.Write(LookupResult{DOI: doi, DoiInfo: info, Error: reportError(err)}); err != nil {
+			return failed, err
+		}
+	}
+
+	return failed, out.Close()
+}
+
+// jsonLookupWriter writes a JSON array of results, as they are looked up
+type jsonLookupWriter struct {
+	w       io.Writer
+	written int
+}
+
+func (j *jsonLookupWriter) Write(result LookupResult) error {
+	separator := ",\n"
+	if j.written == 0 {
+		separator = "[\n"
+	}
+	j.written++
+
+	value, err := json.MarshalIndent(result, "  ", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(j.w, "%s  %s", separator, value)
+	return err
+}
+
+func (j *jsonLookupWriter) Close() error {
+	if j.written == 0 {
+		_, err := fmt.Fprintln(j.w, "[]")
+		return err
+	}
+
+	_, err := fmt.Fprintln(j.w, "\n]")
+	return err
+}
+
+// tableLookupWriter writes a table with a row for each manuscript, for reading in a terminal
+type tableLookupWriter struct {
+	w *tabwriter.Writer
+}
+
+func (t *tableLookupWriter) Write(result LookupResult) error {
+	var err error
+	switch {
+	case result.Error != nil:
+		_, err = fmt.Fprintf(t.w, "%s\t-\t-\terror: %s (%s)\n", result.DOI, result.Error.Detail, result.Error.Code)
+	case result.DoiInfo == nil || len(result.Manuscripts) == 0:
+		_, err = fmt.Fprintf(t.w, "%s\t-\t-\tno manuscripts\n", result.DOI)
+	default:
+		for _, m := range result.Manuscripts {
+			if _, err = fmt.Fprintf(t.w, "%s\t%s\t%s\t%s\n", result.DOI, m.Version, m.RepositoryInstitution, m.Location); err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
+
+func (t *tableLookupWriter) Close() error {
+	return t.w.Flush()
+}
+
+// csvLookupWriter writes a row for each manuscript, for loading into a spreadsheet
+type csvLookupWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvLookupWriter) Write(result LookupResult) error {
+	if result.Error != nil || result.DoiInfo == nil || len(result.Manuscripts) == 0 {
+		var message string
+		if result.Error != nil {
+			message = result.Error.Code + ": " + result.Error.Detail
+		}
+		return c.w.Write([]string{result.DOI, "", "", "", "", "", "", message})
+	}
+
+	for _, m := range result.Manuscripts {
+		if err := c.w.Write([]string{result.DOI, m.Version, m.RepositoryInstitution, m.Name, m.Type, m.Source, m.Location, ""}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvLookupWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
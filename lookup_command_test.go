@@ -0,0 +1,112 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+// mapLookup looks up DOIs in a map.  DOIs that are not in it are not found.
+type mapLookup map[string]*pass.DoiInfo
+
+func (m mapLookup) Lookup(ctx context.Context, doi string) (*pass.DoiInfo, error) {
+	if info, ok := m[doi]; ok {
+		return info, nil
+	}
+	return nil, &pass.Error{Code: pass.CodeDOINotFound, Detail: "DOI not found"}
+}
+
+var testLookups = mapLookup{
+	"10.1234/a": {Manuscripts: []pass.Manuscript{
+		{Location: "http://example.org/a.pdf", Name: "a.pdf", Version: "acceptedVersion", RepositoryInstitution: "Example"},
+		{Location: "http://example.org/b.pdf", Name: "b.pdf", Version: "publishedVersion"},
+	}},
+	"10.1234/none": {},
+}
+
+func lookupAll(t *testing.T, format string, dois ...string) (string, int) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	out, err := pass.NewLookupWriter(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := pass.LookupAll(context.Background(), testLookups, dois, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), failed
+}
+
+func TestLookupJSON(t *testing.T) {
+	output, failed := lookupAll(t, pass.FormatJSON, "10.1234/a", "10.1234/missing")
+	if failed != 1 {
+		t.Errorf("expected one failed lookup, got %d", failed)
+	}
+
+	var results []pass.LookupResult
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		t.Fatalf("invalid JSON output %s: %v", output, err)
+	}
+
+	expected := []pass.LookupResult{
+		{DOI: "10.1234/a", DoiInfo: testLookups["10.1234/a"]},
+		{DOI: "10.1234/missing", Error: &pass.ErrorReport{Code: pass.CodeDOINotFound, Detail: "DOI not found"}},
+	}
+	if diffs := deep.Equal(results, expected); len(diffs) > 0 {
+		t.Errorf("unexpected results: %v", diffs)
+	}
+
+	if output, _ = lookupAll(t, pass.FormatJSON); strings.TrimSpace(output) != "[]" {
+		t.Errorf("expected empty array, got %s", output)
+	}
+}
+
+func TestLookupTable(t *testing.T) {
+	output, _ := lookupAll(t, pass.FormatTable, "10.1234/a", "10.1234/none", "10.1234/missing")
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected a header and 4 rows, got %s", output)
+	}
+
+	for i, expected := range [][]string{
+		{"DOI", "VERSION", "REPOSITORY", "URL"},
+		{"10.1234/a", "acceptedVersion", "Example", "http://example.org/a.pdf"},
+		{"10.1234/a", "publishedVersion", "http://example.org/b.pdf"},
+		{"10.1234/none", "no manuscripts"},
+		{"10.1234/missing", "doi_not_found"},
+	} {
+		for _, field := range expected {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("expected %q in row %q", field, lines[i])
+			}
+		}
+	}
+}
+
+func TestLookupCSV(t *testing.T) {
+	output, _ := lookupAll(t, pass.FormatCSV, "10.1234/a", "10.1234/missing")
+
+	expected := `doi,version,repository,name,type,source,url,error
+10.1234/a,acceptedVersion,Example,a.pdf,,,http://example.org/a.pdf,
+10.1234/a,publishedVersion,,b.pdf,,,http://example.org/b.pdf,
+10.1234/missing,,,,,,,doi_not_found: DOI not found
+`
+	if output != expected {
+		t.Errorf("unexpected CSV output:\n%s", output)
+	}
+}
+
+func TestLookupFormat(t *testing.T) {
+	if _, err := pass.NewLookupWriter(&bytes.Buffer{}, "xml"); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
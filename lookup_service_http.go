@@ -1,35 +1,34 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
 // LookupService looks up a DOI and provides information associated with it
 type LookupService interface {
-	Lookup(doi string) (*DoiInfo, error)
+	Lookup(ctx context.Context, doi string) (*DoiInfo, error)
 }
 
 func LookupServiceHandler(svc LookupService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeProblem(w, r, errorf(CodeMethodNotAllowed, nil, "method %s is not allowed", r.Method))
 			return
 		}
 
 		doi := r.URL.Query().Get("doi")
 
 		if doi == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("No DOI parameter provided"))
+			writeProblem(w, r, errorf(CodeBadInput, nil, "No DOI parameter provided"))
 			return
 		}
 
-		info, err := svc.Lookup(doi)
+		info, err := svc.Lookup(r.Context(), doi)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(err.Error()))
+			writeProblem(w, r, err)
 			return
 		}
 
@@ -40,7 +39,7 @@ func LookupServiceHandler(svc LookupService) http.Handler {
 		err = encoder.Encode(info)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("error encoding JSON response: %s", err)
+			slog.ErrorContext(r.Context(), "error encoding JSON response", "error", err)
 		}
 	})
 }
@@ -1,6 +1,7 @@
 package main_test
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -13,13 +14,13 @@ import (
 
 type MockLookupService func(string) (*pass.DoiInfo, error)
 
-func (f MockLookupService) Lookup(doi string) (*pass.DoiInfo, error) {
+func (f MockLookupService) Lookup(ctx context.Context, doi string) (*pass.DoiInfo, error) {
 	return f(doi)
 }
 
 type NoLookupService struct{}
 
-func (n NoLookupService) Lookup(doi string) (*pass.DoiInfo, error) {
+func (n NoLookupService) Lookup(ctx context.Context, doi string) (*pass.DoiInfo, error) {
 	return nil, nil
 }
 
@@ -91,3 +92,23 @@ func TestResponse(t *testing.T) {
 		t.Fatalf("Bad content type: %s", resp.Header().Get("Content-Type"))
 	}
 }
+
+func TestLookupError(t *testing.T) {
+	resp := httptest.NewRecorder()
+	pass.LookupServiceHandler(MockLookupService(func(doi string) (*pass.DoiInfo, error) {
+		return nil, &pass.Error{Code: pass.CodeUpstreamError, Detail: "unpaywall is down"}
+	})).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/lookup?doi=abc/123", nil))
+
+	if resp.Code != http.StatusBadGateway {
+		t.Errorf("expected bad gateway, got %d", resp.Code)
+	}
+
+	var problem pass.Problem
+	if err := json.Unmarshal(resp.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("could not parse problem: %v", err)
+	}
+
+	if problem.Code != pass.CodeUpstreamError || strings.Contains(problem.Detail, "unpaywall is down") {
+		t.Errorf("unexpected problem %+v", problem)
+	}
+}
@@ -13,10 +13,17 @@ func main() {
 
 func run(args []string) {
 	app := &cli.App{
-		Name:  "PASS download Service",
-		Usage: "Provides HTTP endpoints for looking up DOIs and downloading their manuscripts",
+		Name:      "PASS download Service",
+		Usage:     "Provides HTTP endpoints for looking up DOIs and downloading their manuscripts",
+		Version:   version,
+		ErrWriter: os.Stderr,
 		Commands: []*cli.Command{
 			serve(),
+			lookupCommand(),
+			downloadCommand(),
+			backfillCommand(),
+			cacheCommand(),
+			configCommand(),
 		},
 	}
 
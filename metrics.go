@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "download_service"
+
+// Metrics collects Prometheus metrics for the download service.  Components are
+// instrumented by wrapping them, rather than by collecting metrics within them.
+type Metrics struct {
+	registry          *prometheus.Registry
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	cacheRequests     *prometheus.CounterVec
+	cacheEvictions    prometheus.Counter
+	outboundDuration  *prometheus.HistogramVec
+	receivedBytes     *prometheus.CounterVec
+	storedBytes       prometheus.Counter
+	downloadsInFlight prometheus.Gauge
+}
+
+// NewMetrics creates and registers download service metrics, along with the
+// standard Go runtime and process metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests served, by handler and status code",
+		}, []string{"handler", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests served, by handler and status code",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"handler", "code"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "doi_cache_requests_total",
+			Help:      "Number of DOI cache lookups, by result (hit, hit_stale, hit_not_found, hit_error, or miss)",
+		}, []string{"result"}),
+		cacheEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "doi_cache_evictions_total",
+			Help:      "Number of DOI cache entries evicted due to size or age",
+		}),
+		outboundDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "outbound_request_duration_seconds",
+			Help:      "Latency of outbound HTTP requests, by host and source (e.g. unpaywall, download, fedora).  Download hosts are not distinguished",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"host", "source"}),
+		receivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "received_bytes_total",
+			Help:      "Bytes received in outbound HTTP response bodies, by source.  Source \"download\" is downloaded content",
+		}, []string{"source"}),
+		storedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stored_bytes_total",
+			Help:      "Bytes of binary content successfully stored in Fedora",
+		}),
+		downloadsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "downloads_in_flight",
+			Help:      "Number of downloads currently in progress",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.cacheRequests,
+		m.cacheEvictions,
+		m.outboundDuration,
+		m.receivedBytes,
+		m.storedBytes,
+		m.downloadsInFlight,
+	)
+
+	return m
+}
+
+// Handler serves metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentHandler records request counts and latency for the named handler
+func (m *Metrics) InstrumentHandler(name string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+	return promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(m.requestDuration.MustCurryWith(labels), h))
+}
+
+// InstrumentRequester records latency and received bytes of outbound requests
+// made by the given Requester, labelled with the given source.
+func (m *Metrics) InstrumentRequester(source string, r Requester) Requester {
+	return instrumentedRequester{
+		Requester: r,
+		source:    source,
+		metrics:   m,
+	}
+}
+
+// InstrumentDownloader tracks the number of downloads in flight
+func (m *Metrics) InstrumentDownloader(d Downloader) Downloader {
+	return instrumentedDownloader{
+		Downloader: d,
+		metrics:    m,
+	}
+}
+
+// InstrumentStore records the number of bytes successfully stored
+func (m *Metrics) InstrumentStore(s BinaryStore) BinaryStore {
+	return instrumentedStore{
+		BinaryStore: s,
+		metrics:     m,
+	}
+}
+
+// CacheHit implements CacheObserver.  Hits on DOIs that are not found, or failed lookups,
+// are counted separately from hits on successful lookups.
+func (m *Metrics) CacheHit(state string) {
+	result := "hit"
+	if state != CacheStateFound {
+		result = "hit_" + state
+	}
+	m.cacheRequests.WithLabelValues(result).Inc()
+}
+
+// CacheMiss implements CacheObserver
+func (m *Metrics) CacheMiss() {
+	m.cacheRequests.WithLabelValues("miss").Inc()
+}
+
+// CacheEvicted implements CacheObserver
+func (m *Metrics) CacheEvicted() {
+	m.cacheEvictions.Inc()
+}
+
+type instrumentedRequester struct {
+	Requester
+	source  string
+	metrics *Metrics
+}
+
+func (r instrumentedRequester) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := r.Requester.Do(req)
+	r.metrics.outboundDuration.WithLabelValues(r.host(req), r.source).Observe(time.Since(start).Seconds())
+
+	if resp != nil && resp.Body != nil {
+		resp.Body = countingReadCloser{
+			ReadCloser: resp.Body,
+			counter:    r.metrics.receivedBytes.WithLabelValues(r.source),
+		}
+	}
+
+	return resp, err
+}
+
+// host labels the latency of a request with its host, except for downloads.  Download hosts are
+// whichever publishers Unpaywall names, so labelling them would grow the number of series without limit.
+func (r instrumentedRequester) host(req *http.Request) string {
+	if r.source == "download" {
+		return "other"
+	}
+	return req.URL.Host
+}
+
+type instrumentedDownloader struct {
+	Downloader
+	metrics *Metrics
+}
+
+func (d instrumentedDownloader) Download(ctx context.Context, doi, url string) (*DownloadResult, error) {
+	d.metrics.downloadsInFlight.Inc()
+	defer d.metrics.downloadsInFlight.Dec()
+
+	return d.Downloader.Download(ctx, doi, url)
+}
+
+type instrumentedStore struct {
+	BinaryStore
+	metrics *Metrics
+}
+
+func (s instrumentedStore) PostBinary(ctx context.Context, url string, body io.Reader, contentType string, md BinaryMetadata) (string, error) {
+	counted := &countingReader{Reader: body}
+
+	location, err := s.BinaryStore.PostBinary(ctx, url, counted, contentType, md)
+	if err == nil {
+		s.metrics.storedBytes.Add(float64(counted.n))
+	}
+
+	return location, err
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (c countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,74 @@
+package main_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := pass.NewMetrics()
+
+	location := "http://example.org/file.pdf"
+	content := "some pdf content"
+
+	cache := pass.NewDoiCache(pass.DoiCacheConfig{Observer: metrics})
+	lookup := MockLookupService(func(doi string) (*pass.DoiInfo, error) {
+		return cache.GetOrAdd(context.Background(), doi, func(context.Context) (*pass.DoiInfo, error) {
+			return &pass.DoiInfo{
+				Manuscripts: []pass.Manuscript{{Location: location}},
+			}, nil
+		})
+	})
+
+	downloader := pass.DownloadService{
+		DOIs: lookup,
+		HTTP: metrics.InstrumentRequester("download", MockRequester(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader(content)),
+			}, nil
+		})),
+		Fedora: metrics.InstrumentStore(MockBinaryStore(func(url string, body io.Reader, mimetype string, md pass.BinaryMetadata) (string, error) {
+			_, _ = ioutil.ReadAll(body)
+			return "http://example.org/fedora/file", nil
+		})),
+	}
+
+	lookupHandler := metrics.InstrumentHandler("lookup", pass.LookupServiceHandler(lookup))
+	downloadHandler := metrics.InstrumentHandler("download",
+		pass.DownloadServiceHandler(metrics.InstrumentDownloader(downloader)))
+
+	lookupHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/lookup?doi=abc/123", nil))
+	lookupHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/lookup", nil))
+	downloadHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/download?doi=abc/123&url="+location, nil))
+	metrics.CacheHit(pass.CacheStateNotFound)
+
+	scrape := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	exposed := scrape.Body.String()
+
+	for _, expected := range []string{
+		`download_service_http_requests_total{code="200",handler="lookup"} 1`,
+		`download_service_http_requests_total{code="400",handler="lookup"} 1`,
+		`download_service_http_requests_total{code="201",handler="download"} 1`,
+		`download_service_http_request_duration_seconds_count{code="201",handler="download"} 1`,
+		`download_service_doi_cache_requests_total{result="miss"} 1`,
+		`download_service_doi_cache_requests_total{result="hit"} 1`,
+		`download_service_doi_cache_requests_total{result="hit_not_found"} 1`,
+		`download_service_outbound_request_duration_seconds_count{host="other",source="download"} 1`,
+		`download_service_received_bytes_total{source="download"} 16`,
+		`download_service_stored_bytes_total 16`,
+		`download_service_downloads_in_flight 0`,
+	} {
+		if !strings.Contains(exposed, expected) {
+			t.Errorf("metrics did not contain %s", expected)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RDF namespaces used in binary descriptions
+const (
+	nsDcterms  = "http://purl.org/dc/terms/"
+	nsDownload = "http://oapass.org/ns/download#"
+	nsXsd      = "http://www.w3.org/2001/XMLSchema#"
+)
+
+// version of the download service, recorded in the provenance of stored binaries.
+// It is set at build time via -ldflags "-X main.version=..."
+var version = "dev"
+
+// descriptionUpdate builds a SPARQL update that adds provenance triples for the given
+// metadata and checksum to a binary description.  Empty values are omitted.
+func descriptionUpdate(md BinaryMetadata, checksum string) string {
+	var update strings.Builder
+
+	fmt.Fprintf(&update, "PREFIX dcterms: <%s>\n", nsDcterms)
+	fmt.Fprintf(&update, "PREFIX dl: <%s>\n", nsDownload)
+	fmt.Fprintf(&update, "PREFIX xsd: <%s>\n", nsXsd)
+	update.WriteString("INSERT {\n")
+
+	triple := func(predicate, object string) {
+		fmt.Fprintf(&update, "  <> %s %s .\n", predicate, object)
+	}
+
+	if md.SourceURL != "" {
+		triple("dcterms:source", sparqlIRI(md.SourceURL))
+	}
+	if md.FinalURL != "" {
+		triple("dl:finalURL", sparqlIRI(md.FinalURL))
+	}
+	if md.DOI != "" {
+		triple("dl:doi", sparqlLiteral(md.DOI))
+	}
+	if md.Source != "" {
+		triple("dl:lookupSource", sparqlLiteral(md.Source))
+	}
+	if md.RepositoryInstitution != "" {
+		triple("dl:repositoryInstitution", sparqlLiteral(md.RepositoryInstitution))
+	}
+	if md.Version != "" {
+		triple("dl:manuscriptVersion", sparqlLiteral(md.Version))
+	}
+	if !md.DownloadedAt.IsZero() {
+		triple("dl:downloadedAt", sparqlLiteral(md.DownloadedAt.UTC().Format(time.RFC3339))+"^^xsd:dateTime")
+	}
+	if md.ServiceVersion != "" {
+		triple("dl:serviceVersion", sparqlLiteral(md.ServiceVersion))
+	}
+	if checksum != "" {
+		triple("dl:sha256", sparqlLiteral(checksum))
+	}
+
+	update.WriteString("} WHERE {}\n")
+
+	return update.String()
+}
+
+// sparqlIRI formats a SPARQL IRI reference, percent-encoding any characters
+// that are not allowed to appear in one.
+func sparqlIRI(iri string) string {
+	var b strings.Builder
+
+	b.WriteByte('<')
+	for _, r := range iri {
+		if r <= 0x20 || strings.ContainsRune("<>\"{}|^`\\", r) {
+			fmt.Fprintf(&b, "%%%02X", r)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('>')
+
+	return b.String()
+}
+
+// sparqlLiteral formats a quoted SPARQL string literal
+func sparqlLiteral(s string) string {
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`,
+	).Replace(s) + `"`
+}
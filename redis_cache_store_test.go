@@ -0,0 +1,185 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-test/deep"
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func newRedisCacheStore(t *testing.T) (*pass.RedisCacheStore, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	store, err := pass.NewRedisCacheStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	return store, server
+}
+
+// Make sure that replicas sharing a store only fetch a DOI once
+func TestRedisCacheStoreSharedFetch(t *testing.T) {
+	store, _ := newRedisCacheStore(t)
+
+	contended := &contendedStore{RedisCacheStore: store, contended: make(chan struct{})}
+
+	replica1 := pass.NewDoiCache(pass.DoiCacheConfig{Store: store})
+	replica2 := pass.NewDoiCache(pass.DoiCacheConfig{Store: contended})
+
+	info := &pass.DoiInfo{Manuscripts: []pass.Manuscript{{Location: "http://example.org/file.pdf"}}}
+
+	var fetched int32
+	fetching := make(chan bool)
+	release := make(chan bool)
+	results := make(chan *pass.DoiInfo, 2)
+
+	go func() {
+		result, _ := replica1.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
+			atomic.AddInt32(&fetched, 1)
+			fetching <- true
+			<-release
+			return info, nil
+		})
+		results <- result
+	}()
+
+	<-fetching // replica 1 holds the lock
+
+	go func() {
+		result, _ := replica2.GetOrAdd(context.Background(), "foo", func(context.Context) (*pass.DoiInfo, error) {
+			atomic.AddInt32(&fetched, 1)
+			return info, nil
+		})
+		results <- result
+	}()
+
+	<-contended.contended // replica 2 waits on the lock
+	release <- true
+
+	for i := 0; i < 2; i++ {
+		if diffs := deep.Equal(info, <-results); len(diffs) > 0 {
+			t.Errorf("unexpected result: %v", diffs)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Errorf("expected DOI to be fetched once, was fetched %d times", n)
+	}
+}
+
+// contendedStore reports when a lock could not be taken, because someone else holds it
+type contendedStore struct {
+	*pass.RedisCacheStore
+	contended chan struct{}
+	once      sync.Once
+}
+
+func (s *contendedStore) Lock(ctx context.Context, doi string) (func(), bool, error) {
+	unlock, ok, err := s.RedisCacheStore.Lock(ctx, doi)
+	if err == nil && !ok {
+		s.once.Do(func() { close(s.contended) })
+	}
+	return unlock, ok, err
+}
+
+func TestRedisCacheStoreTTL(t *testing.T) {
+	store, server := newRedisCacheStore(t)
+
+	notFound := &pass.Error{Code: pass.CodeDOINotFound, Detail: "not found"}
+	if _, err := store.Put(context.Background(), "foo", &pass.CachedLookup{Err: notFound, Expires: time.Now().Add(time.Minute)}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup, err := store.Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var coded pass.CodedError
+	if lookup == nil || !errors.As(lookup.Err, &coded) || coded.ErrorCode() != pass.CodeDOINotFound {
+		t.Fatalf("expected stored not found error, got %+v", lookup)
+	}
+
+	server.FastForward(time.Minute)
+
+	if lookup, _ = store.Get(context.Background(), "foo"); lookup != nil {
+		t.Errorf("lookup should have expired")
+	}
+}
+
+func TestRedisCacheStoreLock(t *testing.T) {
+	store, server := newRedisCacheStore(t)
+
+	unlock, ok, err := store.Lock(context.Background(), "foo")
+	if err != nil || !ok {
+		t.Fatalf("could not take lock: %v", err)
+	}
+
+	if _, ok, _ = store.Lock(context.Background(), "foo"); ok {
+		t.Fatalf("lock should have been held")
+	}
+
+	// A lock that expired and was taken by someone else is not released
+	server.FastForward(time.Minute)
+	_, ok, _ = store.Lock(context.Background(), "foo")
+	if !ok {
+		t.Fatalf("expired lock should have been taken")
+	}
+	unlock()
+
+	if _, ok, _ = store.Lock(context.Background(), "foo"); ok {
+		t.Errorf("someone else's lock should not have been released")
+	}
+
+	// Keys are prefixed
+	if !server.Exists("pass-download-service:lock:foo") {
+		t.Errorf("expected prefixed lock key, got %v", server.Keys())
+	}
+}
+
+func TestRedisCacheStorePurge(t *testing.T) {
+	store, server := newRedisCacheStore(t)
+
+	for _, doi := range []string{"a", "b"} {
+		_, _ = store.Put(context.Background(), doi, &pass.CachedLookup{Expires: time.Now().Add(time.Minute)}, time.Now())
+	}
+	unlock, _, _ := store.Lock(context.Background(), "a")
+	defer unlock()
+
+	if n, _ := store.Len(context.Background()); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+
+	purged, err := store.Purge(context.Background())
+	if err != nil || purged != 2 {
+		t.Fatalf("expected 2 purged lookups, got %d, %v", purged, err)
+	}
+
+	// Locks are left alone
+	if !server.Exists("pass-download-service:lock:a") {
+		t.Errorf("lock was purged")
+	}
+}
+
+func TestRedisCacheStoreClock(t *testing.T) {
+	store, server := newRedisCacheStore(t)
+
+	// Expiry is measured by the cache's clock, not the wall clock
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := store.Put(context.Background(), "foo", &pass.CachedLookup{Info: &pass.DoiInfo{}, Expires: now.Add(time.Minute)}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := server.TTL("pass-download-service:doi:foo"); ttl != time.Minute {
+		t.Errorf("expected a TTL of a minute, got %v", ttl)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/urfave/cli/v2"
+)
+
+// liveService is the part of the service built from settings that can be reloaded: where DOIs
+// are looked up, and how manuscripts are downloaded and stored
+type liveService struct {
+	opts      serveOpts
+	unpaywall UnpaywallService
+	fedora    *InternalPassClient
+	download  Downloader
+	auth      Authenticator
+}
+
+// reloadingService looks up DOIs and downloads manuscripts with the current liveService, which is
+// swapped atomically when the configuration is reloaded.  Requests in flight finish with the
+// service they started with.
+type reloadingService struct {
+	current atomic.Pointer[liveService]
+	started serveOpts                             // The settings the service started with
+	build   func(serveOpts) (*liveService, error) // Builds the service for the given settings
+	load    func() (serveOpts, error)             // Loads the settings again, failing if they are invalid
+	log     *slog.Logger
+}
+
+// newReloadingService builds the service for the given settings
+func newReloadingService(opts serveOpts, build func(serveOpts) (*liveService, error), load func() (serveOpts, error), logger *slog.Logger) (*reloadingService, error) {
+	live, err := build(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &reloadingService{started: opts, build: build, load: load, log: logger}
+	s.current.Store(live)
+	return s, nil
+}
+
+// Reload loads the settings again, and swaps in a service built from them.  If they are invalid,
+// the current service is kept.
+func (s *reloadingService) Reload() error {
+	opts, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	for _, setting := range restartSettings(s.started, opts) {
+		s.log.Warn("setting changed, but takes effect only when the service is restarted", "setting", setting)
+	}
+
+	live, err := s.build(opts)
+	if err != nil {
+		return err
+	}
+
+	s.current.Store(live)
+	return nil
+}
+
+func (s *reloadingService) Lookup(ctx context.Context, doi string) (*DoiInfo, error) {
+	return s.current.Load().unpaywall.Lookup(ctx, doi)
+}
+
+func (s *reloadingService) Download(ctx context.Context, doi, url string) (*DownloadResult, error) {
+	return s.current.Load().download.Download(ctx, doi, url)
+}
+
+// Authenticate authenticates API requests with the current authentication settings
+func (s *reloadingService) Authenticate(r *http.Request) (*Principal, error) {
+	return s.current.Load().auth.Authenticate(r)
+}
+
+// Ping checks that Unpaywall is available
+func (s *reloadingService) Ping(ctx context.Context) error {
+	return s.current.Load().unpaywall.Ping(ctx)
+}
+
+// CheckAccess checks that Fedora is available
+func (s *reloadingService) CheckAccess(ctx context.Context) error {
+	return s.current.Load().fedora.CheckAccess(ctx)
+}
+
+// CheckWritable checks that the container binaries are deposited into can be written
+func (s *reloadingService) CheckWritable(ctx context.Context) error {
+	live := s.current.Load()
+	return live.fedora.CheckWritable(ctx, live.opts.downloadDest)
+}
+
+// restartSettings are the names of settings that differ, but are only used when the service starts
+func restartSettings(current, reloaded serveOpts) []string {
+	var changed []string
+	for _, setting := range []struct {
+		name     string
+		current  interface{}
+		reloaded interface{}
+	}{
+		{"port", current.port, reloaded.port},
+		{"admin.port", current.adminPort, reloaded.adminPort},
+		{"admin.token", current.adminToken, reloaded.adminToken},
+		{"cache.size", current.cacheSize, reloaded.cacheSize},
+		{"cache.path", current.cachePath, reloaded.cachePath},
+		{"cache.redis", current.cacheRedisURL, reloaded.cacheRedisURL},
+		{"cache.warm", current.cacheWarm, reloaded.cacheWarm},
+		{"cache.warm.concurrency", current.cacheWarmWorkers, reloaded.cacheWarmWorkers},
+		{"cache.warm.rate", current.cacheWarmRate, reloaded.cacheWarmRate},
+		{"log.level", current.logLevel, reloaded.logLevel},
+		{"log.format", current.logFormat, reloaded.logFormat},
+		{"otlp.endpoint", current.otlpEndpoint, reloaded.otlpEndpoint},
+		{"drain.delay", current.drainDelay, reloaded.drainDelay},
+		{"drain.timeout", current.drainTimeout, reloaded.drainTimeout},
+		{"tls.cert", current.tlsCert, reloaded.tlsCert},
+		{"tls.key", current.tlsKey, reloaded.tlsKey},
+		{"tls.clientca", current.tlsClientCA, reloaded.tlsClientCA},
+	} {
+		if setting.current != setting.reloaded {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// loadServeOpts parses the settings of the serve command from the given command line, the
+// environment, and its config file, just as when the service starts, and validates them
+func loadServeOpts(args []string) (serveOpts, error) {
+	var opts serveOpts
+
+	app := &cli.App{
+		Writer:    io.Discard,
+		ErrWriter: io.Discard,
+		Commands: []*cli.Command{withConfigFile(&cli.Command{
+			Name:  "serve",
+			Flags: serveFlags(&opts),
+			Action: func(*cli.Context) error {
+				return opts.validate(serveChecks...)
+			},
+		})},
+	}
+
+	err := app.Run(args)
+	return opts, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestReload(t *testing.T) {
+	opts := serveOpts{unpaywallEmail: "one@example.org"}
+	reloaded := opts
+	var loadErr error
+
+	build := func(opts serveOpts) (*liveService, error) {
+		return &liveService{opts: opts, unpaywall: UnpaywallService{Email: opts.unpaywallEmail}}, nil
+	}
+	load := func() (serveOpts, error) { return reloaded, loadErr }
+
+	service, err := newReloadingService(opts, build, load, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded.unpaywallEmail = "two@example.org"
+	if err := service.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if email := service.current.Load().unpaywall.Email; email != "two@example.org" {
+		t.Errorf("expected the reloaded email, got %s", email)
+	}
+
+	reloaded.unpaywallEmail = "three@example.org"
+	loadErr = errors.New("invalid configuration")
+	if err := service.Reload(); err == nil {
+		t.Errorf("expected invalid settings not to be reloaded")
+	}
+	if email := service.current.Load().unpaywall.Email; email != "two@example.org" {
+		t.Errorf("expected the current email to be kept, got %s", email)
+	}
+}
+
+func TestReloadingServiceUsesCurrent(t *testing.T) {
+	var downloads []string
+
+	build := func(opts serveOpts) (*liveService, error) {
+		return &liveService{opts: opts, download: downloaderFunc(func(ctx context.Context, doi, url string) (*DownloadResult, error) {
+			downloads = append(downloads, opts.downloadDest)
+			return &DownloadResult{}, nil
+		})}, nil
+	}
+
+	dest := "http://example.org/one"
+	service, err := newReloadingService(serveOpts{downloadDest: dest}, build, func() (serveOpts, error) {
+		return serveOpts{downloadDest: dest}, nil
+	}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = service.Download(context.Background(), "10.1/a", "http://example.org/a.pdf")
+	dest = "http://example.org/two"
+	if err := service.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = service.Download(context.Background(), "10.1/a", "http://example.org/a.pdf")
+
+	if diffs := deep.Equal(downloads, []string{"http://example.org/one", "http://example.org/two"}); len(diffs) > 0 {
+		t.Errorf("expected downloads with the current settings: %v", diffs)
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	started := serveOpts{port: 8091, cachePath: "cache.db", unpaywallEmail: "one@example.org"}
+	reloaded := serveOpts{port: 8080, cachePath: "cache.db", unpaywallEmail: "two@example.org", logLevel: "debug"}
+
+	if diffs := deep.Equal(restartSettings(started, reloaded), []string{"port", "log.level"}); len(diffs) > 0 {
+		t.Errorf("unexpected restart settings: %v", diffs)
+	}
+}
+
+func TestLoadServeOpts(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+unpaywall: {email: pass@example.org, baseuri: "https://api.unpaywall.org/v2"}
+fedora: {internal.baseurl: "http://fcrepo:8080/rest", public.baseurl: "https://pass.example.org/rest"}
+download.dest: http://fcrepo:8080/rest/bin
+auth.disabled: true
+`)
+
+	opts, err := loadServeOpts([]string{"pass-download-service", "serve", "--config", path, "--port", "9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.port != 9000 || opts.unpaywallEmail != "pass@example.org" {
+		t.Errorf("expected settings from the command line and config file, got %+v", opts)
+	}
+
+	path = writeConfig(t, "config.yaml", "unpaywall.email: pass\n")
+	if _, err := loadServeOpts([]string{"pass-download-service", "serve", "--config", path}); err == nil {
+		t.Errorf("expected invalid settings to fail")
+	}
+}
+
+type downloaderFunc func(ctx context.Context, doi, url string) (*DownloadResult, error)
+
+func (f downloaderFunc) Download(ctx context.Context, doi, url string) (*DownloadResult, error) {
+	return f(ctx, doi, url)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Scanner scans content for malware before it is stored.  If the content is
+// infected, Scan returns an ErrorInfected.
+type Scanner interface {
+	Scan(content io.Reader) error
+}
+
+// ErrorInfected is thrown when a scanner finds malware in content.  Its value is the
+// name of the detected signature.
+type ErrorInfected string
+
+func (e ErrorInfected) Error() string {
+	return fmt.Sprintf("malware detected: %s", string(e))
+}
+
+// ErrorCode is the stable code for infected content
+func (e ErrorInfected) ErrorCode() string {
+	return CodeInfected
+}
+
+// HTTPStatus is the HTTP status for infected content
+func (e ErrorInfected) HTTPStatus() int {
+	return codeStatus[CodeInfected]
+}
+
+const (
+	clamdDefaultTimeout = 60 * time.Second
+	clamdChunkSize      = 32 * 1024
+)
+
+// ClamdScanner scans content using the INSTREAM command of a clamd daemon, over TCP
+type ClamdScanner struct {
+	Address string        // host:port of clamd
+	Timeout time.Duration // Timeout for an entire scan, including transferring the content
+}
+
+// Scan streams content to clamd, and interprets its verdict
+func (c ClamdScanner) Scan(content io.Reader) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = clamdDefaultTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", c.Address, timeout)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to clamd at %s", c.Address)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = c.stream(conn, content); err != nil {
+		return errors.Wrapf(err, "could not send content to clamd")
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "could not read reply from clamd")
+	}
+
+	return parseClamdReply(reply)
+}
+
+// stream sends content with the INSTREAM command, as length-prefixed chunks
+// terminated by a zero-length chunk.
+func (c ClamdScanner) stream(conn net.Conn, content io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := content.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return werr
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	binary.BigEndian.PutUint32(size, 0)
+	_, err := conn.Write(size)
+	return err
+}
+
+// parseClamdReply interprets a reply like "stream: OK", "stream: Eicar-Signature FOUND",
+// or "INSTREAM size limit exceeded. ERROR"
+func parseClamdReply(reply string) error {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		return ErrorInfected(strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"))
+	case strings.HasSuffix(reply, "OK"):
+		return nil
+	default:
+		return fmt.Errorf("clamd scan failed: %s", reply)
+	}
+}
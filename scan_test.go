@@ -0,0 +1,214 @@
+package main_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd listens for INSTREAM commands, and reports content containing
+// the EICAR test string as infected
+func fakeClamd(t *testing.T) (address string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start fake clamd: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				command, err := r.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var content bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(content.String(), eicar) {
+					_, _ = conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					_, _ = conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func TestClamdScanner(t *testing.T) {
+	address, stop := fakeClamd(t)
+	defer stop()
+
+	scanner := pass.ClamdScanner{Address: address}
+
+	// Clean content larger than a single chunk
+	if err := scanner.Scan(strings.NewReader(strings.Repeat("clean ", 20000))); err != nil {
+		t.Errorf("clean content should have passed scan: %v", err)
+	}
+
+	err := scanner.Scan(strings.NewReader("prefix " + eicar))
+
+	var infected pass.ErrorInfected
+	if !errors.As(err, &infected) {
+		t.Fatalf("expected infected error, got %v", err)
+	}
+
+	if string(infected) != "Eicar-Signature" {
+		t.Errorf("did not get expected signature, got %s", infected)
+	}
+}
+
+func TestClamdUnavailable(t *testing.T) {
+	address, stop := fakeClamd(t)
+	stop()
+
+	err := pass.ClamdScanner{Address: address}.Scan(strings.NewReader("content"))
+
+	var infected pass.ErrorInfected
+	if err == nil || errors.As(err, &infected) {
+		t.Errorf("expected an error that is not an infection, got %v", err)
+	}
+}
+
+type MockAuditLog func(pass.AuditEvent)
+
+func (f MockAuditLog) Record(event pass.AuditEvent) {
+	f(event)
+}
+
+func TestDownloadInfected(t *testing.T) {
+	address, stop := fakeClamd(t)
+	defer stop()
+
+	location := "http://example.org/file.pdf"
+	staging, _ := ioutil.TempDir("", "staging")
+	defer os.RemoveAll(staging)
+
+	var audited []pass.AuditEvent
+
+	toTest := pass.DownloadService{
+		DOIs: MockLookupService(func(d string) (*pass.DoiInfo, error) {
+			return &pass.DoiInfo{
+				Manuscripts: []pass.Manuscript{{Location: location}},
+			}, nil
+		}),
+		HTTP: MockRequester(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader(eicar)),
+			}, nil
+		}),
+		Fedora: MockBinaryStore(func(url string, body io.Reader, mimetype string, md pass.BinaryMetadata) (string, error) {
+			t.Fatalf("infected content should not have been stored")
+			return "", nil
+		}),
+		Scanner:    pass.ClamdScanner{Address: address},
+		StagingDir: staging,
+		Audit: MockAuditLog(func(e pass.AuditEvent) {
+			audited = append(audited, e)
+		}),
+	}
+
+	_, err := toTest.Download(context.Background(), "abc/123", location)
+
+	var infected pass.ErrorInfected
+	if !errors.As(err, &infected) {
+		t.Fatalf("expected infected error, got %v", err)
+	}
+
+	if len(audited) != 1 || audited[0].Action != pass.AuditInfected || audited[0].Detail != "Eicar-Signature" {
+		t.Errorf("infected content was not audited: %+v", audited)
+	}
+
+	if files, _ := ioutil.ReadDir(staging); len(files) > 0 {
+		t.Errorf("staged content was not removed")
+	}
+}
+
+func TestDownloadScanned(t *testing.T) {
+	address, stop := fakeClamd(t)
+	defer stop()
+
+	location := "http://example.org/file.pdf"
+	staging, _ := ioutil.TempDir("", "staging")
+	defer os.RemoveAll(staging)
+
+	var audited []pass.AuditEvent
+
+	toTest := pass.DownloadService{
+		DOIs: MockLookupService(func(d string) (*pass.DoiInfo, error) {
+			return &pass.DoiInfo{
+				Manuscripts: []pass.Manuscript{{Location: location}},
+			}, nil
+		}),
+		HTTP: MockRequester(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("clean content")),
+			}, nil
+		}),
+		Fedora: MockBinaryStore(func(url string, body io.Reader, mimetype string, md pass.BinaryMetadata) (string, error) {
+			content, _ := ioutil.ReadAll(body)
+			if string(content) != "clean content" {
+				t.Errorf("did not store complete staged content, got %s", content)
+			}
+			return "http://example.org/fedora/file", nil
+		}),
+		Scanner:    pass.ClamdScanner{Address: address},
+		StagingDir: staging,
+		Audit: MockAuditLog(func(e pass.AuditEvent) {
+			audited = append(audited, e)
+		}),
+	}
+
+	ctx := pass.WithPrincipal(context.Background(), &pass.Principal{Name: "user@jhu.edu", Method: pass.AuthShibboleth})
+	if _, err := toTest.Download(ctx, "abc/123", location); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+
+	if len(audited) != 1 || audited[0].Action != pass.AuditDeposit || audited[0].Location != "http://example.org/fedora/file" {
+		t.Errorf("deposit was not audited: %+v", audited)
+	}
+	if len(audited) == 1 && audited[0].Principal != "user@jhu.edu" {
+		t.Errorf("expected the deposit to be audited with its principal, got %+v", audited[0])
+	}
+
+	if files, _ := ioutil.ReadDir(staging); len(files) > 0 {
+		t.Errorf("staged content was not removed")
+	}
+}
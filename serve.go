@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
@@ -22,156 +25,734 @@ type serveOpts struct {
 	fedoraBaseURI       string
 	fedoraUsername      string
 	fedoraPassword      string
+	fedoraVersion       int
 	maxredirects        int
+	stagingDir          string
+	maxSize             int64
+	requirePDF          bool
+	clamdAddress        string
+	logLevel            string
+	logFormat           string
+	otlpEndpoint        string
+	cacheSize           int
+	cacheMaxAge         time.Duration
+	cachePath           string
+	cacheRedisURL       string
+	cacheNotFoundAge    time.Duration
+	cacheErrorAge       time.Duration
+	cacheRevalidate     time.Duration
+	cacheStaleIfError   time.Duration
+	cacheWarm           string
+	cacheWarmWorkers    int
+	cacheWarmRate       float64
+	drainDelay          time.Duration
+	drainTimeout        time.Duration
+	tlsCert             string
+	tlsKey              string
+	tlsClientCA         string
+	caBundle            string
+	authHeader          string
+	authProxies         string
+	authJWKS            string
+	authIssuer          string
+	authAudience        string
+	authAPIKeys         string
+	authDisabled        bool
+	adminPort           int
+	adminToken          string
 }
 
 func serve() *cli.Command {
 
 	var opts serveOpts
 
-	return &cli.Command{
+	return withConfigFile(&cli.Command{
 		Name:  "serve",
 		Usage: "Start the user service web service",
-		Flags: []cli.Flag{
-			&cli.IntFlag{
-				Name:        "port",
-				Usage:       "Port for serving http user service",
-				Required:    false,
-				Destination: &opts.port,
-				EnvVars:     []string{"DOWNLOAD_SERVICE_PORT"},
-				Value:       8091,
-			},
-			&cli.StringFlag{
-				Name:        "download.dest",
-				Usage:       "URI of Fedora container to deposit binaries into",
-				Required:    false,
-				Destination: &opts.downloadDest,
-				EnvVars:     []string{"DOWNLOAD_SERVICE_DEST"},
-			},
-
-			&cli.StringFlag{
-				Name:        "unpaywall.email",
-				Usage:       "Email used for making unpaywall API requests",
-				Required:    false,
-				Destination: &opts.unpaywallEmail,
-				EnvVars:     []string{"UNPAYWALL_REQUEST_EMAIL"},
-			},
-			&cli.StringFlag{
-				Name:        "unpaywall.baseuri",
-				Usage:       "Unpaywall API BaseURI",
-				Required:    false,
-				Destination: &opts.unpaywallBaseURI,
-				EnvVars:     []string{"UNPAYWALL_BASEURI"},
-			},
-			&cli.StringFlag{
-				Name:        "fedora.public.baseurl",
-				Usage:       "External (public) PASS baseurl",
-				Destination: &opts.publicFedoraBaseURI,
-				EnvVars:     []string{"PASS_EXTERNAL_FEDORA_BASEURL"},
-			},
-			&cli.StringFlag{
-				Name:        "fedora.internal.baseurl",
-				Usage:       "Internal (private) PASS baseuri",
-				Destination: &opts.fedoraBaseURI,
-				EnvVars:     []string{"PASS_FEDORA_BASEURL"},
-			},
-			&cli.StringFlag{
-				Name:        "fedora.username",
-				Usage:       "Username for basic auth to Fedora",
-				Destination: &opts.fedoraUsername,
-				EnvVars:     []string{"PASS_FEDORA_USER"},
-			},
-			&cli.StringFlag{
-				Name:        "password, p",
-				Usage:       "Password for basic auth to Fedora",
-				Destination: &opts.fedoraPassword,
-				EnvVars:     []string{"PASS_FEDORA_PASSWORD"},
-			},
-			&cli.IntFlag{
-				Name:        "download.maxredirects",
-				Usage:       "Sets the maximum number of redirects when downloading a file (default: '10')",
-				EnvVars:     []string{"DOWNLOAD_SERVICE_MAXREDIRECTS"},
-				Destination: &opts.maxredirects,
-				Value:       10,
-			},
-		},
+		Flags: serveFlags(&opts),
 		Action: func(c *cli.Context) error {
-			return serveAction(opts)
+			if err := opts.validate(serveChecks...); err != nil {
+				return err
+			}
+			return serveAction(opts, func() (serveOpts, error) {
+				return loadServeOpts(os.Args)
+			})
 		},
-	}
+	})
+}
+
+// serveFlags are the settings of the web service
+func serveFlags(opts *serveOpts) []cli.Flag {
+	return concatFlags([]cli.Flag{
+		&cli.IntFlag{
+			Name:        "port",
+			Usage:       "Port for serving http user service",
+			Required:    false,
+			Destination: &opts.port,
+			EnvVars:     []string{"DOWNLOAD_SERVICE_PORT"},
+			Value:       8091,
+		},
+	}, unpaywallFlags(opts), outboundFlags(opts), fedoraFlags(opts), downloadFlags(opts), []cli.Flag{
+		&cli.IntFlag{
+			Name:        "cache.size",
+			Usage:       "Maximum number of DOI lookups to cache",
+			EnvVars:     []string{"DOI_CACHE_SIZE"},
+			Destination: &opts.cacheSize,
+			Value:       CacheDefaultSize,
+		},
+		&cli.DurationFlag{
+			Name:        "cache.maxage",
+			Usage:       "How long to cache successful DOI lookups",
+			EnvVars:     []string{"DOI_CACHE_MAX_AGE"},
+			Destination: &opts.cacheMaxAge,
+			Value:       CacheDefaultAge,
+		},
+		&cli.StringFlag{
+			Name:        "cache.path",
+			Usage:       "File for storing DOI lookups, so that they survive restarts.  If empty, lookups are cached in memory",
+			EnvVars:     []string{"DOI_CACHE_PATH"},
+			Destination: &opts.cachePath,
+		},
+		&cli.StringFlag{
+			Name:        "cache.redis",
+			Usage:       "URL of a Redis server for caching DOI lookups, shared between replicas (e.g. redis://redis:6379/0)",
+			EnvVars:     []string{"DOI_CACHE_REDIS_URL"},
+			Destination: &opts.cacheRedisURL,
+		},
+		&cli.DurationFlag{
+			Name:        "cache.notfoundage",
+			Usage:       "How long to cache DOIs that Unpaywall does not know, or that are invalid",
+			EnvVars:     []string{"DOI_CACHE_NOTFOUND_AGE"},
+			Destination: &opts.cacheNotFoundAge,
+			Value:       CacheDefaultNotFoundAge,
+		},
+		&cli.DurationFlag{
+			Name:        "cache.errorage",
+			Usage:       "How long to cache failed DOI lookups, before trying again",
+			EnvVars:     []string{"DOI_CACHE_ERROR_AGE"},
+			Destination: &opts.cacheErrorAge,
+			Value:       CacheDefaultErrorAge,
+		},
+		&cli.DurationFlag{
+			Name:        "cache.stalewhilerevalidate",
+			Usage:       "How long past its max age a lookup is returned while it is refreshed in the background.  Zero disables",
+			EnvVars:     []string{"DOI_CACHE_STALE_WHILE_REVALIDATE"},
+			Destination: &opts.cacheRevalidate,
+			Value:       1 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:        "cache.staleiferror",
+			Usage:       "How long past its max age a lookup is returned when refreshing it fails.  Zero disables",
+			EnvVars:     []string{"DOI_CACHE_STALE_IF_ERROR"},
+			Destination: &opts.cacheStaleIfError,
+			Value:       1 * time.Hour,
+		},
+		&cli.StringFlag{
+			Name:        "cache.warm",
+			Usage:       "File or URL of a list of DOIs (one per line) to look up in the background at startup, warming the cache",
+			EnvVars:     []string{"DOI_CACHE_WARM"},
+			Destination: &opts.cacheWarm,
+		},
+		&cli.IntFlag{
+			Name:        "cache.warm.concurrency",
+			Usage:       "Maximum number of concurrent lookups when warming the cache",
+			EnvVars:     []string{"DOI_CACHE_WARM_CONCURRENCY"},
+			Destination: &opts.cacheWarmWorkers,
+			Value:       4,
+		},
+		&cli.Float64Flag{
+			Name:        "cache.warm.rate",
+			Usage:       "Maximum lookups per second when warming the cache.  Zero is unlimited",
+			EnvVars:     []string{"DOI_CACHE_WARM_RATE"},
+			Destination: &opts.cacheWarmRate,
+			Value:       2,
+		},
+		&cli.DurationFlag{
+			Name:        "drain.delay",
+			Usage:       "On shutdown, how long the service reports that it is not ready before it stops accepting requests",
+			EnvVars:     []string{"DRAIN_DELAY"},
+			Destination: &opts.drainDelay,
+			Value:       5 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:        "drain.timeout",
+			Usage:       "On shutdown, how long requests and downloads in flight may take to finish before they are canceled",
+			EnvVars:     []string{"DRAIN_TIMEOUT"},
+			Destination: &opts.drainTimeout,
+			Value:       20 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:        "tls.cert",
+			Usage:       "PEM certificate (chain) file for serving HTTPS.  It is reloaded when it changes.  If empty, HTTP is served",
+			EnvVars:     []string{"TLS_CERT_FILE"},
+			Destination: &opts.tlsCert,
+		},
+		&cli.StringFlag{
+			Name:        "tls.key",
+			Usage:       "PEM private key file of the certificate for serving HTTPS",
+			EnvVars:     []string{"TLS_KEY_FILE"},
+			Destination: &opts.tlsKey,
+		},
+		&cli.StringFlag{
+			Name:        "tls.clientca",
+			Usage:       "PEM bundle of CAs that client certificates are verified against.  If given, the API requires client certificates",
+			EnvVars:     []string{"TLS_CLIENT_CA_FILE"},
+			Destination: &opts.tlsClientCA,
+		},
+		&cli.StringFlag{
+			Name:        "auth.header",
+			Usage:       "Header naming the user, set by an authenticating proxy (e.g. Eppn, set by Shibboleth).  If empty, no header is trusted",
+			EnvVars:     []string{"AUTH_HEADER"},
+			Destination: &opts.authHeader,
+		},
+		&cli.StringFlag{
+			Name:        "auth.proxies",
+			Usage:       "Comma-separated addresses or CIDR ranges of the proxies trusted to set auth.header",
+			EnvVars:     []string{"AUTH_PROXIES"},
+			Destination: &opts.authProxies,
+		},
+		&cli.StringFlag{
+			Name:        "auth.jwks",
+			Usage:       "JSON web key set file of the keys bearer JWTs may be signed with.  If empty, JWTs are not accepted",
+			EnvVars:     []string{"AUTH_JWKS_FILE"},
+			Destination: &opts.authJWKS,
+		},
+		&cli.StringFlag{
+			Name:        "auth.jwt.issuer",
+			Usage:       "Issuer (iss) required of bearer JWTs, if not empty",
+			EnvVars:     []string{"AUTH_JWT_ISSUER"},
+			Destination: &opts.authIssuer,
+		},
+		&cli.StringFlag{
+			Name:        "auth.jwt.audience",
+			Usage:       "Audience (aud) required of bearer JWTs, if not empty",
+			EnvVars:     []string{"AUTH_JWT_AUDIENCE"},
+			Destination: &opts.authAudience,
+		},
+		&cli.StringFlag{
+			Name:        "auth.apikeys",
+			Usage:       "File of API keys, with a name and key on each line, accepted in the X-API-Key header.  If empty, API keys are not accepted",
+			EnvVars:     []string{"AUTH_API_KEYS_FILE"},
+			Destination: &opts.authAPIKeys,
+		},
+		&cli.BoolFlag{
+			Name:        "auth.disabled",
+			Usage:       "Serve the API without authenticating requests.  Required if no authentication is configured",
+			EnvVars:     []string{"AUTH_DISABLED"},
+			Destination: &opts.authDisabled,
+		},
+		&cli.IntFlag{
+			Name:        "admin.port",
+			Usage:       "Port for the admin API, served separately from the public API",
+			EnvVars:     []string{"ADMIN_PORT"},
+			Destination: &opts.adminPort,
+			Value:       8092,
+		},
+		&cli.StringFlag{
+			Name:        "admin.token",
+			Usage:       "Bearer token required by the admin API.  If empty, the admin API is disabled",
+			EnvVars:     []string{"ADMIN_TOKEN"},
+			Destination: &opts.adminToken,
+		},
+	}, logFlags(opts), []cli.Flag{
+		&cli.StringFlag{
+			Name:        "otlp.endpoint",
+			Usage:       "OTLP/HTTP endpoint for exporting traces (e.g. http://collector:4318).  If empty, tracing is disabled",
+			EnvVars:     []string{"OTEL_EXPORTER_OTLP_ENDPOINT"},
+			Destination: &opts.otlpEndpoint,
+		},
+	})
 }
 
-func serveAction(opts serveOpts) error {
+// serveAction runs the service until it is interrupted or terminated, then drains it.  On SIGHUP, the
+// settings are loaded again by reload, and lookups and downloads use them from then on.
+func serveAction(opts serveOpts, reload func() (serveOpts, error)) error {
 
-	jar, _ := cookiejar.New(nil)
+	logger, err := NewLogger(os.Stderr, opts.logLevel, opts.logFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	if opts.otlpEndpoint != "" {
+		shutdownTracing, err := InitTracing(context.Background(), opts.otlpEndpoint)
+		if err != nil {
+			return fmt.Errorf("could not initialize tracing: %w", err)
+		}
+		defer func() {
+			_ = shutdownTracing(context.Background())
+		}()
+	}
+
+	rootCAs, err := opts.rootCAs()
+	if err != nil {
+		return err
+	}
+
+	metrics := NewMetrics()
+	requester := LogRequests(logger, newHTTPClient(opts.maxredirects, rootCAs))
+
+	var cacheStore CacheStore
+	var cacheChecks []Check
+	switch {
+	case opts.cachePath != "":
+		boltStore, err := OpenBoltCacheStore(opts.cachePath, opts.cacheSize)
+		if err != nil {
+			return err
+		}
+		defer boltStore.Close()
+		cacheStore = boltStore
+	case opts.cacheRedisURL != "":
+		redisStore, err := NewRedisCacheStore(opts.cacheRedisURL)
+		if err != nil {
+			return err
+		}
+		defer redisStore.Close()
+		cacheStore = redisStore
+		cacheChecks = append(cacheChecks, Check{Name: "cache", Check: redisStore.Ping})
+	}
+
+	cacheConfig := opts.cacheConfig()
+	cacheConfig.MaxSize = opts.cacheSize
+	cacheConfig.Store = cacheStore
+	cacheConfig.Observer = metrics
+	cacheConfig.Log = logger
+	cache := NewDoiCache(cacheConfig)
+
+	// Lookups and downloads are rebuilt from the settings when they are reloaded
+	build := func(opts serveOpts) (*liveService, error) {
+		rootCAs, err := opts.rootCAs()
+		if err != nil {
+			return nil, err
+		}
+
+		auth, err := opts.authenticator()
+		if err != nil {
+			return nil, err
+		}
+		if opts.authDisabled {
+			logger.Warn("the API does not authenticate requests, since auth.disabled is set")
+		}
+
+		cache.Reconfigure(opts.cacheConfig())
+
+		requester := LogRequests(logger, newHTTPClient(opts.maxredirects, rootCAs))
+
+		unpaywall := UnpaywallService{
+			HTTP:    metrics.InstrumentRequester("unpaywall", requester),
+			Baseuri: opts.unpaywallBaseURI,
+			Email:   opts.unpaywallEmail,
+			Cache:   cache,
+			Log:     logger,
+		}
+
+		fedora, store := opts.fedora(metrics.InstrumentRequester("fedora", PropagateTrace(requester)), logger)
+
+		downloadService := opts.downloadService(metrics.InstrumentRequester("download", requester), unpaywall,
+			metrics.InstrumentStore(TraceStore(store)), logger)
+
+		return &liveService{opts: opts, unpaywall: unpaywall, fedora: fedora, download: downloadService, auth: auth}, nil
+	}
+	service, err := newReloadingService(opts, build, reload, logger)
+	if err != nil {
+		return err
+	}
+
+	// The API authenticates requests, but health checks and metrics do not.  With TLS, the
+	// certificate is reloaded when its files change.  If client certificates are verified, they are
+	// required by the API too.
+	var certs *CertificateReloader
+	var tlsConfig *tls.Config
+	api := func(h http.Handler) http.Handler { return RequireAuthentication(service, h) }
+	if opts.tlsCert != "" {
+		if certs, err = LoadCertificate(opts.tlsCert, opts.tlsKey, logger); err != nil {
+			return err
+		}
+
+		watchCtx, stopWatching := context.WithCancel(context.Background())
+		defer stopWatching()
+		go certs.Watch(watchCtx, certificateCheckInterval)
+
+		var clientCAs *x509.CertPool
+		if opts.tlsClientCA != "" {
+			if clientCAs, err = LoadCertPool(nil, opts.tlsClientCA); err != nil {
+				return err
+			}
+			authenticated := api
+			api = func(h http.Handler) http.Handler { return RequireClientCertificate(authenticated(h)) }
+		}
+		tlsConfig = ServerTLSConfig(certs, clientCAs)
+	}
+
+	drainer := NewDrainer(logger)
+
+	mux := http.NewServeMux()
+	mux.Handle("/lookup", metrics.InstrumentHandler("lookup",
+		TraceHandler("lookup", api(LookupServiceHandler(service)))))
+	mux.Handle("/download", metrics.InstrumentHandler("download",
+		TraceHandler("download", api(DownloadServiceHandler(metrics.InstrumentDownloader(drainer.Downloader(service)))))))
+	mux.Handle("/metrics", metrics.Handler())
+
+	readiness := &Readiness{
+		Checks: append([]Check{
+			{Name: "fedora", Check: service.CheckAccess},
+			{Name: "download.dest", Check: service.CheckWritable},
+			{Name: "unpaywall", Check: service.Ping},
+		}, cacheChecks...),
+		Drainer: drainer,
+	}
+
+	stopWarming := func() {}
+	if opts.cacheWarm != "" {
+		readiness.Warming = &CacheWarmer{
+			DOIs:        service,
+			HTTP:        requester,
+			Concurrency: opts.cacheWarmWorkers,
+			Rate:        opts.cacheWarmRate,
+			Log:         logger,
+		}
+
+		var warmCtx context.Context
+		warmCtx, stopWarming = context.WithCancel(context.Background())
+		defer stopWarming()
+		go func() {
+			if err := readiness.Warming.Warm(warmCtx, opts.cacheWarm); err != nil && warmCtx.Err() == nil {
+				logger.Error("could not warm DOI cache", "error", err)
+			}
+		}()
+	}
 
-	httpClient := &http.Client{
-		Timeout: 20 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) >= opts.maxredirects {
-				return fmt.Errorf("serve: maximum number of redirects reached (%v) for %v",
-					opts.maxredirects, req.URL.String())
+	mux.Handle("/healthz", LivenessHandler())
+	mux.Handle("/readyz", ReadinessHandler(readiness))
+
+	server := drainer.Serve(&http.Server{
+		Addr:      fmt.Sprintf(":%d", opts.port),
+		Handler:   RequestIDHandler(AccessLogHandler(logger, mux)),
+		TLSConfig: tlsConfig,
+	})
+
+	servers := []*http.Server{server}
+	if opts.adminToken != "" {
+		servers = append(servers, drainer.Serve(&http.Server{
+			Addr:      fmt.Sprintf(":%d", opts.adminPort),
+			Handler:   RequestIDHandler(AccessLogHandler(logger, RequireToken(opts.adminToken, AdminHandler(cache)))),
+			TLSConfig: tlsConfig,
+		}))
+	} else {
+		logger.Info("admin API is disabled, since no admin token is configured")
+	}
+
+	stop := make(chan os.Signal, 1)
+	hup := make(chan os.Signal, 1)
+	done := make(chan error, len(servers))
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for _, server := range servers {
+		go func(server *http.Server) {
+			logger.Info("listening", "address", server.Addr, "tls", server.TLSConfig != nil)
+			if server.TLSConfig != nil {
+				done <- server.ListenAndServeTLS("", "")
+				return
 			}
+			done <- server.ListenAndServe()
+		}(server)
+	}
 
+	for {
+		select {
+		case <-hup:
+			if certs != nil {
+				if _, err := certs.Reload(); err != nil {
+					logger.Error("could not reload certificate, so keeping the current one", "error", err)
+				}
+			}
+			if err := service.Reload(); err != nil {
+				logger.Error("could not reload configuration, so keeping the current one", "error", err)
+				continue
+			}
+			logger.Info("reloaded configuration")
+		case <-stop:
+			stopWarming()
+			if err := drainer.Drain(opts.drainDelay, opts.drainTimeout, stop, servers...); err != nil {
+				return err
+			}
+			logger.Info("goodbye!")
 			return nil
-		},
-		Jar: jar,
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+// cacheConfig is how long DOI lookups are cached
+func (opts serveOpts) cacheConfig() DoiCacheConfig {
+	return DoiCacheConfig{
+		MaxAge:               opts.cacheMaxAge,
+		NotFoundAge:          opts.cacheNotFoundAge,
+		ErrorAge:             opts.cacheErrorAge,
+		StaleWhileRevalidate: opts.cacheRevalidate,
+		StaleIfError:         opts.cacheStaleIfError,
 	}
+}
 
-	var fedoraCredentials *Credentials
+// fedora creates a Fedora client, and the store for binaries appropriate to its version
+func (opts serveOpts) fedora(requester Requester, logger *slog.Logger) (*InternalPassClient, BinaryStore) {
+	var credentials *Credentials
 	if opts.fedoraUsername != "" {
-		fedoraCredentials = &Credentials{
+		credentials = &Credentials{
 			Username: opts.fedoraUsername,
 			Password: opts.fedoraPassword,
 		}
 	}
 
-	unpaywall := UnpaywallService{
-		HTTP:    httpClient,
-		Baseuri: opts.unpaywallBaseURI,
-		Email:   opts.unpaywallEmail,
-		Cache: NewDoiCache(DoiCacheConfig{
-			MaxAge:  1 * time.Minute,
-			MaxSize: 100,
-		}),
+	fedora := &InternalPassClient{
+		Requester:       requester,
+		Credentials:     credentials,
+		ExternalBaseURI: opts.publicFedoraBaseURI,
+		InternalBaseURI: opts.fedoraBaseURI,
+		Log:             logger,
 	}
 
+	if opts.fedoraVersion >= 6 {
+		return fedora, &TransactionalPassClient{InternalPassClient: *fedora}
+	}
+	return fedora, fedora
+}
+
+// downloadService creates a download service that stores binaries in the given store
+func (opts serveOpts) downloadService(requester Requester, dois LookupService, store BinaryStore, logger *slog.Logger) DownloadService {
 	downloadService := DownloadService{
-		HTTP: httpClient,
-		DOIs: unpaywall,
-		Dest: opts.downloadDest,
-		Fedora: &InternalPassClient{
-			Requester:       httpClient,
-			Credentials:     fedoraCredentials,
-			ExternalBaseURI: opts.publicFedoraBaseURI,
-			InternalBaseURI: opts.fedoraBaseURI,
+		HTTP:       requester,
+		DOIs:       dois,
+		Dest:       opts.downloadDest,
+		Fedora:     store,
+		StagingDir: opts.stagingDir,
+		MaxSize:    opts.maxSize,
+		RequirePDF: opts.requirePDF,
+		Audit:      SlogAuditLog{logger},
+		Log:        logger,
+	}
+
+	if opts.clamdAddress != "" {
+		downloadService.Scanner = ClamdScanner{Address: opts.clamdAddress}
+	}
+
+	return downloadService
+}
+
+// unpaywallFlags configure the Unpaywall API, for every command that looks up DOIs
+func unpaywallFlags(opts *serveOpts) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "unpaywall.email",
+			Usage:       "Email used for making unpaywall API requests",
+			Required:    false,
+			Destination: &opts.unpaywallEmail,
+			EnvVars:     []string{"UNPAYWALL_REQUEST_EMAIL"},
+		},
+		&cli.StringFlag{
+			Name:        "unpaywall.baseuri",
+			Usage:       "Unpaywall API BaseURI",
+			Required:    false,
+			Destination: &opts.unpaywallBaseURI,
+			EnvVars:     []string{"UNPAYWALL_BASEURI"},
 		},
 	}
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("/lookup", LookupServiceHandler(unpaywall))
-	mux.Handle("/download", DownloadServiceHandler(downloadService))
+// outboundFlags configure outbound connections, for every command that makes them
+func outboundFlags(opts *serveOpts) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "http.cabundle",
+			Usage:       "PEM bundle of CAs trusted for outbound connections (e.g. to Fedora, or internal repositories), as well as the system's",
+			EnvVars:     []string{"HTTP_CA_BUNDLE"},
+			Destination: &opts.caBundle,
+		},
+	}
+}
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", opts.port),
-		Handler: mux,
+// logFlags configure logging, for every command that logs
+func logFlags(opts *serveOpts) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "log.level",
+			Usage:       "Log level: debug, info, warn, or error",
+			EnvVars:     []string{"LOG_LEVEL"},
+			Destination: &opts.logLevel,
+			Value:       "info",
+		},
+		&cli.StringFlag{
+			Name:        "log.format",
+			Usage:       "Log format: json or text",
+			EnvVars:     []string{"LOG_FORMAT"},
+			Destination: &opts.logFormat,
+			Value:       "json",
+		},
 	}
+}
 
-	stop := make(chan os.Signal, 1)
-	done := make(chan error, 1)
-	signal.Notify(stop, os.Interrupt)
-
-	go func() {
-		log.Printf("Listening on port %d", opts.port)
-		done <- server.ListenAndServe()
-	}()
-
-	select {
-	case <-stop:
-		_ = server.Shutdown(context.Background())
-		log.Printf("Goodbye!")
-		return nil
-	case err := <-done:
-		return err
+// fedoraFlags configure access to Fedora, for every command that stores downloads
+func fedoraFlags(opts *serveOpts) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "fedora.public.baseurl",
+			Usage:       "External (public) PASS baseurl",
+			Destination: &opts.publicFedoraBaseURI,
+			EnvVars:     []string{"PASS_EXTERNAL_FEDORA_BASEURL"},
+		},
+		&cli.StringFlag{
+			Name:        "fedora.internal.baseurl",
+			Usage:       "Internal (private) PASS baseuri",
+			Destination: &opts.fedoraBaseURI,
+			EnvVars:     []string{"PASS_FEDORA_BASEURL"},
+		},
+		&cli.StringFlag{
+			Name:        "fedora.username",
+			Usage:       "Username for basic auth to Fedora",
+			Destination: &opts.fedoraUsername,
+			EnvVars:     []string{"PASS_FEDORA_USER"},
+		},
+		&cli.StringFlag{
+			Name:        "fedora.password",
+			Aliases:     []string{"password", "p"},
+			Usage:       "Password for basic auth to Fedora",
+			Destination: &opts.fedoraPassword,
+			EnvVars:     []string{"PASS_FEDORA_PASSWORD"},
+		},
+		&cli.IntFlag{
+			Name:        "fedora.version",
+			Usage:       "Major version of Fedora.  Version 6 stores binaries and their descriptions in a transaction",
+			Destination: &opts.fedoraVersion,
+			EnvVars:     []string{"PASS_FEDORA_VERSION"},
+			Value:       4,
+		},
+	}
+}
+
+// downloadFlags configure downloading, for every command that downloads manuscripts
+func downloadFlags(opts *serveOpts) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "download.dest",
+			Usage:       "URI of Fedora container to deposit binaries into",
+			Required:    false,
+			Destination: &opts.downloadDest,
+			EnvVars:     []string{"DOWNLOAD_SERVICE_DEST"},
+		},
+		maxRedirectsFlag(opts),
+		&cli.StringFlag{
+			Name:        "download.staging",
+			Usage:       "Directory where downloads are staged while being scanned for malware (default: system temp dir)",
+			EnvVars:     []string{"DOWNLOAD_SERVICE_STAGING"},
+			Destination: &opts.stagingDir,
+		},
+		&cli.Int64Flag{
+			Name:        "download.maxsize",
+			Usage:       "Maximum size of a download, in bytes.  Zero means no limit",
+			EnvVars:     []string{"DOWNLOAD_SERVICE_MAXSIZE"},
+			Destination: &opts.maxSize,
+		},
+		&cli.BoolFlag{
+			Name:        "download.requirepdf",
+			Usage:       "Refuse downloads that are not PDFs (e.g. HTML login pages)",
+			EnvVars:     []string{"DOWNLOAD_SERVICE_REQUIREPDF"},
+			Destination: &opts.requirePDF,
+		},
+		&cli.StringFlag{
+			Name:        "clamd.address",
+			Usage:       "host:port of a clamd daemon for scanning downloads for malware.  If empty, downloads are not scanned",
+			EnvVars:     []string{"CLAMD_ADDRESS"},
+			Destination: &opts.clamdAddress,
+		},
+	}
+}
+
+// maxRedirectsFlag limits the redirects followed by outbound requests, for commands that look up
+// DOIs without downloading too
+func maxRedirectsFlag(opts *serveOpts) cli.Flag {
+	return &cli.IntFlag{
+		Name:        "download.maxredirects",
+		Usage:       "Sets the maximum number of redirects when downloading a file (default: '10')",
+		EnvVars:     []string{"DOWNLOAD_SERVICE_MAXREDIRECTS"},
+		Destination: &opts.maxredirects,
+		Value:       10,
+	}
+}
+
+func concatFlags(groups ...[]cli.Flag) []cli.Flag {
+	var flags []cli.Flag
+	for _, group := range groups {
+		flags = append(flags, group...)
+	}
+	return flags
+}
+
+// newHTTPClient creates the client for outbound requests, following at most maxRedirects redirects.
+// If rootCAs is nil, servers are verified against the system's CAs.
+func newHTTPClient(maxRedirects int, rootCAs *x509.CertPool) *http.Client {
+	jar, _ := cookiejar.New(nil)
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if rootCAs != nil {
+		custom := http.DefaultTransport.(*http.Transport).Clone()
+		custom.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+		transport = custom
+	}
+
+	return &http.Client{
+		Timeout:       20 * time.Second,
+		CheckRedirect: LimitRedirects(maxRedirects),
+		Jar:           jar,
+		Transport:     TraceTransport(transport),
+	}
+}
+
+// rootCAs are the CAs outbound connections are verified against: the system's, and those in the
+// CA bundle.  If there is no bundle, it is nil.
+func (opts serveOpts) rootCAs() (*x509.CertPool, error) {
+	if opts.caBundle == "" {
+		return nil, nil
+	}
+
+	system, _ := x509.SystemCertPool() // Only the bundle is trusted if the system's CAs are unavailable
+	return LoadCertPool(system, opts.caBundle)
+}
+
+// authenticator authenticates API requests with each of the configured methods.  If there are none,
+// every request is anonymous, which the settings only allow if auth.disabled is set (or client
+// certificates are required).
+func (opts serveOpts) authenticator() (Authenticator, error) {
+	var auth Authenticators
+
+	if opts.authHeader != "" {
+		proxies, err := ParseProxies(opts.authProxies)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, HeaderAuthenticator{Header: opts.authHeader, Proxies: proxies})
+	}
+
+	if opts.authJWKS != "" {
+		keys, err := LoadJWKS(opts.authJWKS)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, JWTAuthenticator{Keys: keys, Issuer: opts.authIssuer, Audience: opts.authAudience})
+	}
+
+	if opts.authAPIKeys != "" {
+		keys, err := LoadAPIKeys(opts.authAPIKeys)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, keys)
+	}
+
+	if len(auth) == 0 {
+		return Anonymous{}, nil
 	}
+	return auth, nil
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HostThrottle is a Requester that spaces out requests to each host by at least Interval, so
+// that no one host is hammered by concurrent work.  Only the first request of any redirects
+// is spaced out.
+type HostThrottle struct {
+	Requester
+	Interval time.Duration
+
+	m    sync.Mutex
+	next map[string]time.Time // When the next request to each host may be made
+}
+
+// Do waits until a request may be made to its host, then makes it
+func (t *HostThrottle) Do(req *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	if t.next == nil {
+		t.next = make(map[string]time.Time)
+	}
+	at := time.Now()
+	if next := t.next[req.URL.Host]; next.After(at) {
+		at = next
+	}
+	t.next[req.URL.Host] = at.Add(t.Interval)
+	t.m.Unlock()
+
+	if wait := time.Until(at); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	return t.Requester.Do(req)
+}
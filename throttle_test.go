@@ -0,0 +1,47 @@
+package main_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+func TestHostThrottle(t *testing.T) {
+	var m sync.Mutex
+	times := make(map[string][]time.Time)
+
+	throttle := &pass.HostThrottle{
+		Requester: MockRequester(func(req *http.Request) (*http.Response, error) {
+			m.Lock()
+			defer m.Unlock()
+			times[req.URL.Host] = append(times[req.URL.Host], time.Now())
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		Interval: 50 * time.Millisecond,
+	}
+
+	var wg sync.WaitGroup
+	for _, url := range []string{"http://a.example/1", "http://a.example/2", "http://a.example/3", "http://b.example/1"} {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			_, _ = throttle.Do(req)
+		}(url)
+	}
+	wg.Wait()
+
+	a := times["a.example"]
+	for i := 1; i < len(a); i++ {
+		if gap := a[i].Sub(a[i-1]); gap < 45*time.Millisecond {
+			t.Errorf("requests to the same host were only %v apart", gap)
+		}
+	}
+
+	if b := times["b.example"]; len(b) != 1 || b[0].Sub(a[0]) > 40*time.Millisecond {
+		t.Errorf("request to another host should not have waited")
+	}
+}
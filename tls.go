@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certificateCheckInterval is how often certificate files are checked for changes
+const certificateCheckInterval = 30 * time.Second
+
+// CertificateReloader serves a certificate and key from files, loading them again when they change,
+// e.g. when they are renewed.  If the changed files cannot be loaded (e.g. only one of them has
+// been written so far), the current certificate is kept.
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+	Log      *slog.Logger
+
+	m       sync.Mutex
+	cert    atomic.Pointer[tls.Certificate]
+	content []byte // The cert and key files the current certificate was loaded from
+}
+
+// LoadCertificate loads a certificate and its key from files
+func LoadCertificate(certFile, keyFile string, logger *slog.Logger) (*CertificateReloader, error) {
+	r := &CertificateReloader{CertFile: certFile, KeyFile: keyFile, Log: logger}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Reload loads the certificate and key again if the files have changed, reporting whether they had
+func (r *CertificateReloader) Reload() (bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	certPEM, err := os.ReadFile(r.CertFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read certificate: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(r.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read certificate key: %w", err)
+	}
+
+	content := append(append([]byte(nil), certPEM...), keyPEM...)
+	if bytes.Equal(content, r.content) {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("could not load certificate %s and key %s: %w", r.CertFile, r.KeyFile, err)
+	}
+
+	r.cert.Store(&cert)
+	r.content = content
+	return true, nil
+}
+
+// Watch reloads the certificate whenever its files change, checking them at the given interval
+// until the context is done
+func (r *CertificateReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if reloaded, err := r.Reload(); err != nil {
+				loggerOrDefault(r.Log).Error("could not reload certificate, so keeping the current one", "error", err)
+			} else if reloaded {
+				loggerOrDefault(r.Log).Info("reloaded certificate", "cert", r.CertFile)
+			}
+		}
+	}
+}
+
+// ServerTLSConfig configures a server to use the certificate of the reloader.  If clientCAs is
+// not nil, client certificates are verified against it, when they are given; use
+// RequireClientCertificate to require them.
+func ServerTLSConfig(certs *CertificateReloader, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config
+}
+
+// RequireClientCertificate refuses requests that were not made with a verified client certificate
+func RequireClientCertificate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeProblem(w, r, errorf(CodeUnauthorized, nil, "a verified client certificate is required"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// LoadCertPool adds the PEM certificates in a bundle file to a pool.  If the pool is nil, a new
+// one is created.
+func LoadCertPool(pool *x509.CertPool, bundle string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA bundle: %w", err)
+	}
+
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", bundle)
+	}
+
+	return pool, nil
+}
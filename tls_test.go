@@ -0,0 +1,277 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a certificate for the given name, returning its PEM certificate and key
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes content to the named file in dir, returning its path
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveTLS serves the handler over HTTPS with the given config, returning its URL
+func serveTLS(t *testing.T, config *tls.Config, handler http.Handler) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: handler, TLSConfig: config}
+	go func() { _ = server.ServeTLS(listener, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	return "https://" + listener.Addr().String()
+}
+
+// tlsClient trusts the given CA, and presents the given client certificates
+func tlsClient(t *testing.T, ca *testCA, certs ...tls.Certificate) *http.Client {
+	roots, err := pass.LoadCertPool(nil, writeFile(t, t.TempDir(), "ca.pem", ca.pem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+	}}
+}
+
+func TestCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+
+	certPEM, keyPEM := ca.issue(t, "one.example.org", x509.ExtKeyUsageServerAuth)
+	certFile := writeFile(t, dir, "cert.pem", certPEM)
+	keyFile := writeFile(t, dir, "key.pem", keyPEM)
+
+	certs, err := pass.LoadCertificate(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject := func() string {
+		cert, _ := certs.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	if reloaded, err := certs.Reload(); err != nil || reloaded {
+		t.Errorf("expected unchanged files not to be reloaded, got %t, %v", reloaded, err)
+	}
+
+	// Only the certificate has been renewed so far, so it does not match the key
+	certPEM, keyPEM = ca.issue(t, "two.example.org", x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "cert.pem", certPEM)
+
+	if _, err := certs.Reload(); err == nil {
+		t.Errorf("expected a certificate that does not match its key not to be loaded")
+	}
+	if name := subject(); name != "one.example.org" {
+		t.Errorf("expected the current certificate to be kept, got %s", name)
+	}
+
+	writeFile(t, dir, "key.pem", keyPEM)
+
+	if reloaded, err := certs.Reload(); err != nil || !reloaded {
+		t.Fatalf("expected the renewed certificate to be reloaded, got %t, %v", reloaded, err)
+	}
+	if name := subject(); name != "two.example.org" {
+		t.Errorf("expected the renewed certificate, got %s", name)
+	}
+}
+
+func TestLoadCertificateErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := pass.LoadCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), nil); err == nil {
+		t.Errorf("expected an error loading missing files")
+	}
+
+	garbage := writeFile(t, dir, "garbage.pem", []byte("not a certificate"))
+	if _, err := pass.LoadCertificate(garbage, garbage, nil); err == nil {
+		t.Errorf("expected an error loading a file that is not a certificate")
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+
+	certPEM, keyPEM := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	certs, err := pass.LoadCertificate(writeFile(t, dir, "cert.pem", certPEM), writeFile(t, dir, "key.pem", keyPEM), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs, err := pass.LoadCertPool(nil, writeFile(t, dir, "clientca.pem", ca.pem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := serveTLS(t, pass.ServerTLSConfig(certs, clientCAs), pass.RequireClientCertificate(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		})))
+
+	resp, err := tlsClient(t, ca).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a request without a client certificate to be unauthorized, got %d", resp.StatusCode)
+	}
+
+	clientPEM, clientKeyPEM := ca.issue(t, "client.example.org", x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = tlsClient(t, ca, clientCert).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected a request with a client certificate to succeed, got %d", resp.StatusCode)
+	}
+
+	// A certificate from another CA is refused in the handshake
+	otherPEM, otherKeyPEM := newTestCA(t).issue(t, "client.example.org", x509.ExtKeyUsageClientAuth)
+	otherCert, err := tls.X509KeyPair(otherPEM, otherKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := tlsClient(t, ca, otherCert).Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected a client certificate from another CA to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+
+	// A server with a certificate from a private CA is trusted by adding the CA to the pool
+	certPEM, keyPEM := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	certs, err := pass.LoadCertificate(writeFile(t, dir, "cert.pem", certPEM), writeFile(t, dir, "key.pem", keyPEM), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := serveTLS(t, pass.ServerTLSConfig(certs, nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected a certificate from a private CA not to be trusted by default")
+	}
+
+	resp, err := tlsClient(t, ca).Get(url)
+	if err != nil {
+		t.Fatalf("expected a certificate from the CA bundle to be trusted, got %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := pass.LoadCertPool(nil, writeFile(t, dir, "empty.pem", []byte("no certificates"))); err == nil {
+		t.Errorf("expected an error loading a bundle without certificates")
+	}
+	if _, err := pass.LoadCertPool(nil, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("expected an error loading a missing bundle")
+	}
+}
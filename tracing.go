@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/oa-pass/pass-download-service"
+
+// tracer returns the tracer used for all download service spans
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// InitTracing exports spans to the given OTLP/HTTP endpoint (e.g. http://collector:4318),
+// and propagates W3C trace context.  The returned function flushes and stops the exporter.
+func InitTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "pass-download-service"),
+			attribute.String("service.version", version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// TraceHandler starts a server span for each request to the named handler, continuing
+// any trace context from the incoming request.
+func TraceHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" /"+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", RequestID(ctx)),
+			))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// TraceTransport starts a client span for each outbound round trip, so that every hop of
+// a redirect chain has its own span.
+func TraceTransport(rt http.RoundTripper) http.RoundTripper {
+	return tracedTransport{rt}
+}
+
+type tracedTransport struct {
+	http.RoundTripper
+}
+
+func (t tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), req.Method+" "+req.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", RedactURL(req.URL.String())),
+			attribute.String("server.address", req.URL.Host),
+		))
+	defer span.End()
+
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// PropagateTrace injects W3C trace context into outbound requests made by the given requester
+func PropagateTrace(r Requester) Requester {
+	return propagatingRequester{r}
+}
+
+type propagatingRequester struct {
+	Requester
+}
+
+func (p propagatingRequester) Do(req *http.Request) (*http.Response, error) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	return p.Requester.Do(req)
+}
+
+// TraceStore starts a span for each binary stored
+func TraceStore(s BinaryStore) BinaryStore {
+	return tracedStore{s}
+}
+
+type tracedStore struct {
+	BinaryStore
+}
+
+func (s tracedStore) PostBinary(ctx context.Context, url string, body io.Reader, contentType string, md BinaryMetadata) (string, error) {
+	ctx, span := tracer().Start(ctx, "PostBinary", trace.WithAttributes(
+		attribute.String("fedora.container", url),
+		attribute.String("doi", md.DOI),
+		attribute.String("content.type", contentType),
+	))
+	defer span.End()
+
+	location, err := s.BinaryStore.PostBinary(ctx, url, body, contentType, md)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return location, err
+	}
+
+	span.SetAttributes(attribute.String("fedora.location", location))
+	return location, nil
+}
+
+// traceRedirect records a span for a redirect hop, as seen by an http.Client CheckRedirect
+// function, along with the error (if any) that stops the redirect.
+func traceRedirect(req *http.Request, via []*http.Request, err error) {
+	_, span := tracer().Start(req.Context(), "redirect", trace.WithAttributes(
+		attribute.Int("redirect.hop", len(via)),
+		attribute.String("redirect.from", RedactURL(via[len(via)-1].URL.String())),
+		attribute.String("redirect.to", RedactURL(req.URL.String())),
+	))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedBody ends a span once the body has been entirely read, or closed
+type tracedBody struct {
+	io.ReadCloser
+	span  trace.Span
+	bytes int64
+	ended bool
+}
+
+func newTracedBody(ctx context.Context, name string, body io.ReadCloser) *tracedBody {
+	_, span := tracer().Start(ctx, name)
+	return &tracedBody{ReadCloser: body, span: span}
+}
+
+func (t *tracedBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.bytes += int64(n)
+
+	if err == io.EOF {
+		t.end(nil)
+	} else if err != nil {
+		t.end(err)
+	}
+
+	return n, err
+}
+
+func (t *tracedBody) Close() error {
+	t.end(nil)
+	return t.ReadCloser.Close()
+}
+
+func (t *tracedBody) end(err error) {
+	if t.ended {
+		return
+	}
+	t.ended = true
+
+	t.span.SetAttributes(attribute.Int64("transfer.bytes", t.bytes))
+	if err != nil {
+		t.span.RecordError(err)
+		t.span.SetStatus(codes.Error, err.Error())
+	}
+	t.span.End()
+}
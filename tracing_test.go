@@ -0,0 +1,129 @@
+package main_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pass "github.com/oa-pass/pass-download-service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	// Serves the manuscript after a redirect
+	publisher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/article" {
+			http.Redirect(w, r, "/article.pdf", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer publisher.Close()
+
+	unpaywallResponse, err := ioutil.ReadFile("testdata/real_response.json")
+	if err != nil {
+		t.Fatalf("could not read test response: %v", err)
+	}
+	manuscript := publisher.URL + "/article"
+	unpaywallResponse = []byte(strings.Replace(string(unpaywallResponse), "http://arxiv.org/pdf/1304.1068", manuscript, -1))
+
+	unpaywall := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(unpaywallResponse)
+	}))
+	defer unpaywall.Close()
+
+	fedora := newFakeFedora(t)
+	defer fedora.Close()
+
+	client := &http.Client{
+		CheckRedirect: pass.LimitRedirects(10),
+		Transport:     pass.TraceTransport(http.DefaultTransport),
+	}
+
+	lookup := pass.UnpaywallService{
+		HTTP:    client,
+		Baseuri: unpaywall.URL,
+		Cache:   pass.NewDoiCache(pass.DoiCacheConfig{}),
+	}
+
+	handler := pass.TraceHandler("download", pass.DownloadServiceHandler(pass.DownloadService{
+		HTTP: client,
+		DOIs: lookup,
+		Dest: fedora.URL + "/rest/files",
+		Fedora: pass.TraceStore(&pass.InternalPassClient{
+			Requester:       pass.PropagateTrace(client),
+			InternalBaseURI: fedora.URL + "/rest",
+			ExternalBaseURI: fedora.URL + "/rest",
+		}),
+	}))
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost,
+		"/download?doi=10.1038/abc&url="+url.QueryEscape(manuscript), nil))
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("download failed with %d: %s", resp.Code, resp.Body.String())
+	}
+
+	// Second lookup is a cache hit
+	_, _ = lookup.Lookup(context.Background(), "10.1038/abc")
+
+	spans := exporter.GetSpans()
+	server := find(t, spans, "POST /download")
+
+	for _, name := range []string{"DoiCache.GetOrAdd", "Unpaywall lookup", "redirect", "transfer body", "PostBinary"} {
+		span := find(t, spans, name)
+		if span.SpanContext.TraceID() != server.SpanContext.TraceID() {
+			t.Errorf("span %s is not part of the request trace", name)
+		}
+	}
+
+	var cacheResults []string
+	var hops int
+	for _, span := range spans {
+		for _, attr := range span.Attributes {
+			if attr.Key == attribute.Key("cache.result") {
+				cacheResults = append(cacheResults, attr.Value.AsString())
+			}
+		}
+		if strings.HasPrefix(span.Name, "GET "+strings.TrimPrefix(publisher.URL, "http://")) {
+			hops++
+		}
+	}
+
+	if strings.Join(cacheResults, ",") != "miss,hit" {
+		t.Errorf("expected a cache miss then hit, got %v", cacheResults)
+	}
+
+	if hops != 2 {
+		t.Errorf("expected a client span for each of 2 redirect hops, got %d", hops)
+	}
+
+	if !strings.Contains(fedora.traceparent, server.SpanContext.TraceID().String()) {
+		t.Errorf("trace context was not propagated to Fedora, got traceparent '%s'", fedora.traceparent)
+	}
+}
+
+func find(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no span named %s", name)
+	return tracetest.SpanStub{}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Fedora 6 transaction API
+const (
+	headerAtomicID = "Atomic-ID"
+	txEndpoint     = "fcr:tx"
+)
+
+// TransactionalPassClient stores binaries in a Fedora 6 repository.  Each binary is
+// POSTed and its description written within a single fcr:tx transaction, which is
+// committed only if every step succeeds, and rolled back otherwise.
+type TransactionalPassClient struct {
+	InternalPassClient
+}
+
+// PostBinary POSTs binary content to the given container, and records its provenance
+// and SHA-256 checksum on its fcr:metadata description.
+func (c *TransactionalPassClient) PostBinary(ctx context.Context, url string, body io.Reader, contentType string, md BinaryMetadata) (string, error) {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not start Fedora transaction")
+	}
+
+	location, err := c.postDescribed(ctx, tx, url, body, contentType, md)
+	if err == nil {
+		err = c.commit(ctx, tx)
+	}
+
+	if err != nil {
+		cleanupCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+		if rbErr := c.rollback(cleanupCtx, tx); rbErr != nil {
+			loggerOrDefault(c.Log).ErrorContext(ctx, "could not roll back transaction", "tx", tx, "error", rbErr)
+		}
+		return "", err
+	}
+
+	return c.translateToPublic(location)
+}
+
+// begin opens a new transaction, returning its URI
+func (c *TransactionalPassClient) begin(ctx context.Context) (string, error) {
+	request, err := c.newRequest(ctx, http.MethodPost, c.InternalBaseURI+"/"+txEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.exec("", request)
+	if err != nil {
+		return "", err
+	}
+
+	tx := resp.Header.Get(headerLocation)
+	if tx == "" {
+		return "", errors.New("no transaction location returned by Fedora")
+	}
+
+	return tx, nil
+}
+
+func (c *TransactionalPassClient) commit(ctx context.Context, tx string) error {
+	request, err := c.newRequest(ctx, http.MethodPut, tx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.exec("", request)
+	return errors.Wrapf(err, "could not commit transaction %s", tx)
+}
+
+func (c *TransactionalPassClient) rollback(ctx context.Context, tx string) error {
+	request, err := c.newRequest(ctx, http.MethodDelete, tx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.exec("", request)
+	return err
+}
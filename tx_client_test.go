@@ -0,0 +1,211 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+// fakeFedora implements just enough of the Fedora binary, description, and
+// Fedora 6 transaction APIs for testing
+type fakeFedora struct {
+	sync.Mutex
+	*httptest.Server
+	failOn      string // request "METHOD path" to fail
+	committed   bool
+	rolledBack  bool
+	untracked   []string // non-transaction requests made without an Atomic-ID
+	description string
+	deleted     bool
+	slug        string
+	disposition string
+	traceparent string
+}
+
+func newFakeFedora(t *testing.T) *fakeFedora {
+	f := &fakeFedora{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+
+		tx := f.URL + "/rest/fcr:tx/123"
+		call := r.Method + " " + r.URL.Path
+
+		if call == f.failOn {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("oops"))
+			return
+		}
+
+		switch call {
+		case "POST /rest/fcr:tx":
+			w.Header().Set("Location", tx)
+			w.WriteHeader(http.StatusCreated)
+			return
+		case "PUT /rest/fcr:tx/123":
+			f.committed = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case "DELETE /rest/fcr:tx/123":
+			f.rolledBack = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Header.Get("Atomic-ID") != tx {
+			f.untracked = append(f.untracked, call)
+		}
+
+		switch call {
+		case "POST /rest/files":
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != "content" {
+				t.Errorf("got unexpected binary content %s", body)
+			}
+			f.slug = r.Header.Get("Slug")
+			f.traceparent = r.Header.Get("traceparent")
+			f.disposition = r.Header.Get("Content-Disposition")
+			w.Header().Set("Location", f.URL+"/rest/files/abc")
+			w.WriteHeader(http.StatusCreated)
+		case "PATCH /rest/files/abc/fcr:metadata":
+			if r.Header.Get("Content-Type") != "application/sparql-update" {
+				t.Errorf("wrong content type for description update: %s", r.Header.Get("Content-Type"))
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			f.description = string(body)
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE /rest/files/abc":
+			f.deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return f
+}
+
+func TestTransactionalPostBinary(t *testing.T) {
+	fedora := newFakeFedora(t)
+	defer fedora.Close()
+
+	toTest := pass.TransactionalPassClient{
+		InternalPassClient: pass.InternalPassClient{
+			Requester:       fedora.Client(),
+			InternalBaseURI: fedora.URL + "/rest",
+			ExternalBaseURI: "http://example.org/rest",
+		},
+	}
+
+	uri, err := toTest.PostBinary(context.Background(), fedora.URL+"/rest/files", strings.NewReader("content"), "text/plain", pass.BinaryMetadata{
+		SourceURL:             "http://example.org/some file.pdf",
+		FinalURL:              "http://example.org/final.pdf",
+		DOI:                   "10.1234/\"quoted\"",
+		Source:                "Unpaywall",
+		RepositoryInstitution: "Example",
+		Version:               "acceptedVersion",
+		DownloadedAt:          time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		ServiceVersion:        "1.0.0",
+	})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+
+	if uri != "http://example.org/rest/files/abc" {
+		t.Errorf("did not get public uri of binary, got %s", uri)
+	}
+
+	if !fedora.committed || fedora.rolledBack {
+		t.Errorf("transaction should have been committed and not rolled back")
+	}
+
+	if len(fedora.untracked) > 0 {
+		t.Errorf("requests were made outside the transaction: %v", fedora.untracked)
+	}
+
+	// sha256 of "content"
+	checksum := "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+
+	for _, expected := range []string{
+		"<> dcterms:source <http://example.org/some%20file.pdf>",
+		"<> dl:finalURL <http://example.org/final.pdf>",
+		`<> dl:doi "10.1234/\"quoted\""`,
+		`<> dl:lookupSource "Unpaywall"`,
+		`<> dl:repositoryInstitution "Example"`,
+		`<> dl:manuscriptVersion "acceptedVersion"`,
+		`<> dl:downloadedAt "2020-01-02T03:04:05Z"^^xsd:dateTime`,
+		`<> dl:serviceVersion "1.0.0"`,
+		fmt.Sprintf(`<> dl:sha256 "%s"`, checksum),
+	} {
+		if !strings.Contains(fedora.description, expected) {
+			t.Errorf("description update did not contain %s:\n%s", expected, fedora.description)
+		}
+	}
+}
+
+func TestTransactionalRollback(t *testing.T) {
+	cases := map[string]string{
+		"binary post fails":        "POST /rest/files",
+		"description update fails": "PATCH /rest/files/abc/fcr:metadata",
+		"commit fails":             "PUT /rest/fcr:tx/123",
+	}
+
+	for name, failOn := range cases {
+		failOn := failOn
+		t.Run(name, func(t *testing.T) {
+			fedora := newFakeFedora(t)
+			defer fedora.Close()
+			fedora.failOn = failOn
+
+			toTest := pass.TransactionalPassClient{
+				InternalPassClient: pass.InternalPassClient{
+					Requester:       fedora.Client(),
+					InternalBaseURI: fedora.URL + "/rest",
+					ExternalBaseURI: "http://example.org/rest",
+				},
+			}
+
+			_, err := toTest.PostBinary(context.Background(), fedora.URL+"/rest/files", strings.NewReader("content"), "text/plain", pass.BinaryMetadata{})
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+
+			if !fedora.rolledBack {
+				t.Errorf("transaction should have been rolled back")
+			}
+		})
+	}
+}
+
+func TestTransactionalRollbackCanceled(t *testing.T) {
+	fedora := newFakeFedora(t)
+	defer fedora.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toTest := pass.TransactionalPassClient{
+		InternalPassClient: pass.InternalPassClient{
+			Requester:       cancelOn(http.MethodPatch, cancel, fedora.Client()),
+			InternalBaseURI: fedora.URL + "/rest",
+			ExternalBaseURI: "http://example.org/rest",
+		},
+	}
+
+	_, err := toTest.PostBinary(ctx, fedora.URL+"/rest/files", strings.NewReader("content"), "text/plain", pass.BinaryMetadata{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if fedora.committed || !fedora.rolledBack {
+		t.Errorf("transaction should have been rolled back, even though the deposit was canceled")
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // UnpaywallService looks up DOI info from unpaywall
@@ -15,6 +22,7 @@ type UnpaywallService struct {
 	Email   string    // Email for unpaywall requests
 	Baseuri string    // Unpaywall baseURI
 	Cache   *DoiCache // Can be nil if no caching is desired
+	Log     *slog.Logger
 }
 
 // DOI lookup response from unpaywall
@@ -29,13 +37,17 @@ type unpaywallLocation struct {
 }
 
 // Lookup looks up DOI info for a given DOI
-func (u UnpaywallService) Lookup(doi string) (*DoiInfo, error) {
+func (u UnpaywallService) Lookup(ctx context.Context, doi string) (*DoiInfo, error) {
 
-	generator := func() (*DoiInfo, error) {
+	generator := func(ctx context.Context) (*DoiInfo, error) {
+		ctx, span := tracer().Start(ctx, "Unpaywall lookup", trace.WithAttributes(attribute.String("doi", doi)))
+		defer span.End()
 
-		results, err := u.get(u.apiRequestURI(doi))
+		results, err := u.get(ctx, doi)
 
 		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
 			return nil, fmt.Errorf("unpaywall API request failed: %w", err)
 		}
 
@@ -49,7 +61,8 @@ func (u UnpaywallService) Lookup(doi string) (*DoiInfo, error) {
 				var fileName string
 				decodedURLForPdf, err := url.QueryUnescape(location.URLForPdf)
 				if err != nil {
-					log.Printf("file name decoding failed: %s", err)
+					loggerOrDefault(u.Log).WarnContext(ctx, "file name decoding failed",
+						"doi", doi, "url", location.URLForPdf, "error", err)
 				} else {
 					splitURLForPdf := strings.Split(decodedURLForPdf, "/")
 					fileName = splitURLForPdf[len(splitURLForPdf)-1]
@@ -61,6 +74,7 @@ func (u UnpaywallService) Lookup(doi string) (*DoiInfo, error) {
 					Type:                  "application/pdf",
 					Source:                "Unpaywall",
 					Name:                  fileName,
+					Version:               location.Version,
 				})
 			}
 		}
@@ -69,29 +83,55 @@ func (u UnpaywallService) Lookup(doi string) (*DoiInfo, error) {
 	}
 
 	if u.Cache != nil {
-		return u.Cache.GetOrAdd(doi, generator)
+		return u.Cache.GetOrAdd(ctx, doi, generator)
 	}
 
-	return generator()
+	return generator(ctx)
 }
 
 func (u UnpaywallService) apiRequestURI(doi string) string {
 	return fmt.Sprintf("%s/%s?email=%s", u.Baseuri, doi, u.Email)
 }
 
-func (u UnpaywallService) get(uri string) (*unpaywallDOIResponse, error) {
-	req, err := http.NewRequest(http.MethodGet, uri, nil)
+func (u UnpaywallService) get(ctx context.Context, doi string) (*unpaywallDOIResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.apiRequestURI(doi), nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not form unpaywall API request: %w", err)
 	}
 
-	resp, err := mustSucceed(u.HTTP.Do(req))
+	resp, err := u.HTTP.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("unpaywall request failed: %w", err)
+		return nil, errorf(CodeUpstreamUnavailable, err, "unpaywall request failed")
 	}
 
 	defer resp.Body.Close()
 
+	if err = statusError(doi, resp); err != nil {
+		return nil, err
+	}
+
 	var raw unpaywallDOIResponse
-	return &raw, json.NewDecoder(resp.Body).Decode(&raw)
+	if err = json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, errorf(CodeUpstreamError, err, "could not parse unpaywall response")
+	}
+
+	return &raw, nil
+}
+
+// statusError translates an unsuccessful unpaywall response into an error.  Unpaywall
+// answers 404 for DOIs it does not know, and 422 for strings that are not DOIs at all.
+func statusError(doi string, resp *http.Response) error {
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusNotFound:
+		return errorf(CodeDOINotFound, nil, "DOI %s is not known to unpaywall", doi)
+	case code == http.StatusUnprocessableEntity:
+		return errorf(CodeInvalidDOI, nil, "%s is not a valid DOI", doi)
+	case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+		return errorf(CodeUpstreamUnavailable, nil, "unpaywall is unavailable, with code %d", code)
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errorf(CodeUpstreamError, nil, "unpaywall request failed with code %d and message '%s'", code, body)
+	}
 }
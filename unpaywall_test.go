@@ -1,6 +1,9 @@
 package main_test
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
@@ -24,6 +27,7 @@ func TestUnpaywall(t *testing.T) {
 				Type:                  "application/pdf",
 				Source:                "Unpaywall",
 				Name:                  "Nanometer-Scale Thermometry.pdf",
+				Version:               "publishedVersion",
 			},
 			{
 				Location:              "http://europepmc.org/articles/pmc4221854?pdf=render",
@@ -31,6 +35,7 @@ func TestUnpaywall(t *testing.T) {
 				Type:                  "application/pdf",
 				Source:                "Unpaywall",
 				Name:                  "pmc4221854?pdf=render",
+				Version:               "acceptedVersion",
 			},
 			{
 				Location:              "http://arxiv.org/pdf/1304.1068",
@@ -38,6 +43,7 @@ func TestUnpaywall(t *testing.T) {
 				Type:                  "application/pdf",
 				Source:                "Unpaywall",
 				Name:                  "1304.1068",
+				Version:               "submittedVersion",
 			},
 		},
 	}
@@ -68,7 +74,7 @@ func TestUnpaywall(t *testing.T) {
 		Cache:   pass.NewDoiCache(pass.DoiCacheConfig{}),
 	}
 
-	result, err := toTest.Lookup(doi)
+	result, err := toTest.Lookup(context.Background(), doi)
 	if err != nil {
 		t.Fatalf("Lookup failed: %v", err)
 	}
@@ -79,3 +85,60 @@ func TestUnpaywall(t *testing.T) {
 	}
 
 }
+
+func TestUnpaywallErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		err    error
+		code   string
+		state  string
+	}{
+		{"not found", http.StatusNotFound, `{"error": true}`, nil, pass.CodeDOINotFound, pass.CacheStateNotFound},
+		{"invalid doi", http.StatusUnprocessableEntity, `{"error": true}`, nil, pass.CodeInvalidDOI, pass.CacheStateNotFound},
+		{"unavailable", http.StatusServiceUnavailable, "", nil, pass.CodeUpstreamUnavailable, pass.CacheStateError},
+		{"server error", http.StatusInternalServerError, "oops", nil, pass.CodeUpstreamError, pass.CacheStateError},
+		{"unparseable", http.StatusOK, "<html>", nil, pass.CodeUpstreamError, pass.CacheStateError},
+		{"connection error", 0, "", errors.New("cannot connect"), pass.CodeUpstreamUnavailable, pass.CacheStateError},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			requests := 0
+			observer := &recordingObserver{}
+			toTest := pass.UnpaywallService{
+				HTTP: MockRequester(func(req *http.Request) (*http.Response, error) {
+					requests++
+					if c.err != nil {
+						return nil, c.err
+					}
+					return &http.Response{
+						StatusCode: c.status,
+						Body:       ioutil.NopCloser(strings.NewReader(c.body)),
+					}, nil
+				}),
+				Baseuri: "http://example.org/unpaywall/v2",
+				Cache:   pass.NewDoiCache(pass.DoiCacheConfig{Observer: observer}),
+			}
+
+			for i := 0; i < 2; i++ {
+				_, err := toTest.Lookup(context.Background(), "test/foo")
+
+				var coded pass.CodedError
+				if !errors.As(err, &coded) || coded.ErrorCode() != c.code {
+					t.Fatalf("expected a %s error, got %v", c.code, err)
+				}
+			}
+
+			if requests != 1 {
+				t.Errorf("expected error to be cached, but unpaywall was queried %d times", requests)
+			}
+
+			if len(observer.hits) != 1 || observer.hits[0] != c.state {
+				t.Errorf("expected a %s cache hit, got %v", c.state, observer.hits)
+			}
+		})
+	}
+}
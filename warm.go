@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const cacheWarmDefaultConcurrency = 4
+
+// States of cache warming
+const (
+	WarmingLoading  = "loading"  // The DOI list is being read
+	WarmingRunning  = "running"  // DOIs are being looked up
+	WarmingFinished = "finished" // All DOIs have been looked up
+	WarmingFailed   = "failed"   // The DOI list could not be read
+	WarmingCanceled = "canceled" // Warming was stopped before all DOIs were looked up
+)
+
+// doiPrefixes are stripped from DOIs in a list, so that it may contain DOI URLs
+var doiPrefixes = []string{"https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "http://dx.doi.org/", "doi:"}
+
+// CacheWarmer pre-populates a DOI cache, by looking up a list of DOIs (e.g. those of PASS
+// publications) in the background.  Lookups are limited in number and rate, so that
+// Unpaywall is not overwhelmed.
+type CacheWarmer struct {
+	DOIs        LookupService // Looks up DOIs, through the cache to be warmed
+	HTTP        Requester     // For fetching DOI lists from URLs
+	Concurrency int           // Maximum number of concurrent lookups.  If zero, a default is used
+	Rate        float64       // Maximum lookups per second.  If zero, unlimited
+	Log         *slog.Logger
+
+	m        sync.Mutex
+	progress WarmingProgress
+}
+
+// WarmingProgress describes how far cache warming has got
+type WarmingProgress struct {
+	State  string `json:"state"`
+	Source string `json:"source"`
+	Total  int    `json:"total"`  // DOIs in the list
+	Done   int    `json:"done"`   // DOIs looked up, successfully or not
+	Failed int    `json:"failed"` // DOIs whose lookup failed, including those that are not found
+	Error  string `json:"error,omitempty"`
+}
+
+// Progress reports how far cache warming has got
+func (w *CacheWarmer) Progress() WarmingProgress {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.progress
+}
+
+// Warm reads a list of DOIs from a file or http(s) URL, and looks up each of them.  The list
+// has a DOI (or DOI URL) on each line; blank lines and lines starting with # are ignored.
+// Failed lookups are counted, but do not stop warming.  It returns once all DOIs have been
+// looked up, or the context is canceled.
+func (w *CacheWarmer) Warm(ctx context.Context, source string) error {
+	w.update(func(p *WarmingProgress) { *p = WarmingProgress{State: WarmingLoading, Source: source} })
+
+	dois, err := w.read(ctx, source)
+	if err != nil {
+		w.update(func(p *WarmingProgress) { p.State, p.Error = WarmingFailed, err.Error() })
+		return err
+	}
+
+	w.update(func(p *WarmingProgress) { p.State, p.Total = WarmingRunning, len(dois) })
+	w.log().InfoContext(ctx, "warming DOI cache", "source", RedactURL(source), "dois", len(dois))
+
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = cacheWarmDefaultConcurrency
+	}
+
+	var tick <-chan time.Time
+	if w.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / w.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for doi := range jobs {
+				w.lookup(ctx, doi)
+			}
+		}()
+	}
+
+	func() {
+		defer close(jobs)
+		for i, doi := range dois {
+			if tick != nil && i > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case jobs <- doi:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		w.update(func(p *WarmingProgress) { p.State = WarmingCanceled })
+		return ctx.Err()
+	}
+
+	progress := w.Progress()
+	w.log().InfoContext(ctx, "warmed DOI cache", "dois", progress.Total, "failed", progress.Failed)
+	w.update(func(p *WarmingProgress) { p.State = WarmingFinished })
+	return nil
+}
+
+func (w *CacheWarmer) lookup(ctx context.Context, doi string) {
+	_, err := w.DOIs.Lookup(ctx, doi)
+	if err != nil && ctx.Err() == nil {
+		w.log().DebugContext(ctx, "could not warm DOI", "doi", doi, "error", err)
+	}
+
+	w.update(func(p *WarmingProgress) {
+		p.Done++
+		if err != nil {
+			p.Failed++
+		}
+	})
+}
+
+// read reads a list of DOIs from a file or URL
+func (w *CacheWarmer) read(ctx context.Context, source string) ([]string, error) {
+	var list io.ReadCloser
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not form request for DOI list %s", RedactURL(source))
+		}
+
+		resp, err := w.HTTP.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch DOI list %s", RedactURL(source))
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("could not fetch DOI list %s: status %d", RedactURL(source), resp.StatusCode)
+		}
+		list = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open DOI list")
+		}
+		list = file
+	}
+	defer list.Close()
+
+	dois, err := readDOIs(list)
+	return dois, errors.Wrapf(err, "could not read DOI list %s", RedactURL(source))
+}
+
+// readDOIs reads a list of distinct DOIs, one on each line.  DOI URLs are reduced to their
+// DOIs.  Blank lines and lines starting with # are ignored.
+func readDOIs(list io.Reader) ([]string, error) {
+	var dois []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		doi := strings.TrimSpace(scanner.Text())
+		if doi == "" || strings.HasPrefix(doi, "#") {
+			continue
+		}
+
+		if doi = trimDOI(doi); !seen[doi] {
+			seen[doi] = true
+			dois = append(dois, doi)
+		}
+	}
+
+	return dois, scanner.Err()
+}
+
+// trimDOI reduces a DOI URL to its DOI
+func trimDOI(doi string) string {
+	for _, prefix := range doiPrefixes {
+		doi = strings.TrimPrefix(doi, prefix)
+	}
+	return doi
+}
+
+func (w *CacheWarmer) update(change func(*WarmingProgress)) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	change(&w.progress)
+}
+
+func (w *CacheWarmer) log() *slog.Logger {
+	return loggerOrDefault(w.Log)
+}
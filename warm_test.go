@@ -0,0 +1,162 @@
+package main_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	pass "github.com/oa-pass/pass-download-service"
+)
+
+// countingLookup records the DOIs it looks up, and how many lookups run at once
+type countingLookup struct {
+	m       sync.Mutex
+	dois    []string
+	running int
+	most    int
+	delay   time.Duration
+	fail    map[string]bool
+}
+
+func (c *countingLookup) Lookup(ctx context.Context, doi string) (*pass.DoiInfo, error) {
+	c.m.Lock()
+	c.dois = append(c.dois, doi)
+	c.running++
+	c.most = max(c.most, c.running)
+	c.m.Unlock()
+
+	time.Sleep(c.delay)
+
+	c.m.Lock()
+	c.running--
+	c.m.Unlock()
+
+	if c.fail[doi] {
+		return nil, &pass.Error{Code: pass.CodeDOINotFound, Detail: "not found"}
+	}
+	return &pass.DoiInfo{}, nil
+}
+
+func writeDOIList(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "dois.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWarmFromFile(t *testing.T) {
+	list := writeDOIList(t, `# Publication DOIs
+10.1234/a
+  https://doi.org/10.1234/b
+
+doi:10.1234/c
+10.1234/a
+`)
+
+	lookup := &countingLookup{fail: map[string]bool{"10.1234/c": true}}
+	warmer := &pass.CacheWarmer{DOIs: lookup}
+
+	if err := warmer.Warm(context.Background(), list); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(lookup.dois)
+	if diffs := deep.Equal(lookup.dois, []string{"10.1234/a", "10.1234/b", "10.1234/c"}); len(diffs) > 0 {
+		t.Errorf("unexpected DOIs looked up: %v", diffs)
+	}
+
+	progress := warmer.Progress()
+	if progress.State != pass.WarmingFinished || progress.Total != 3 || progress.Done != 3 || progress.Failed != 1 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+}
+
+func TestWarmLimits(t *testing.T) {
+	list := writeDOIList(t, "a\nb\nc\nd\ne\nf\n")
+
+	lookup := &countingLookup{delay: 50 * time.Millisecond}
+	warmer := &pass.CacheWarmer{DOIs: lookup, Concurrency: 2}
+
+	_ = warmer.Warm(context.Background(), list)
+	if lookup.most != 2 {
+		t.Errorf("expected at most 2 concurrent lookups, got %d", lookup.most)
+	}
+
+	lookup = &countingLookup{}
+	warmer = &pass.CacheWarmer{DOIs: lookup, Concurrency: 6, Rate: 50}
+
+	start := time.Now()
+	_ = warmer.Warm(context.Background(), list)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("6 lookups at 50 per second took only %v", elapsed)
+	}
+}
+
+func TestWarmFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dois.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("10.1234/a\n10.1234/b\n"))
+	}))
+	defer server.Close()
+
+	lookup := &countingLookup{}
+	warmer := &pass.CacheWarmer{DOIs: lookup, HTTP: server.Client()}
+
+	if err := warmer.Warm(context.Background(), server.URL+"/dois.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(lookup.dois) != 2 {
+		t.Errorf("expected 2 lookups, got %v", lookup.dois)
+	}
+
+	if err := warmer.Warm(context.Background(), server.URL+"/missing.txt"); err == nil {
+		t.Errorf("expected error fetching missing list")
+	}
+	if progress := warmer.Progress(); progress.State != pass.WarmingFailed || progress.Error == "" {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+}
+
+func TestWarmCanceled(t *testing.T) {
+	list := writeDOIList(t, "a\nb\nc\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	warmer := &pass.CacheWarmer{DOIs: &countingLookup{}, Rate: 1}
+	if err := warmer.Warm(ctx, list); err == nil {
+		t.Errorf("expected canceled warming to fail")
+	}
+	if progress := warmer.Progress(); progress.State != pass.WarmingCanceled || progress.Done == 3 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+}
+
+func TestReadinessWarming(t *testing.T) {
+	warmer := &pass.CacheWarmer{DOIs: &countingLookup{}}
+	readiness := &pass.Readiness{Warming: warmer}
+
+	if report := readiness.Report(); report.Warming == nil || report.Warming.State != "" {
+		t.Errorf("expected warming not started, got %+v", report.Warming)
+	}
+
+	_ = warmer.Warm(context.Background(), writeDOIList(t, "a\n"))
+
+	// Progress is current, even though dependency checks are cached
+	if report := readiness.Report(); !report.Ready || report.Warming.State != pass.WarmingFinished {
+		t.Errorf("expected finished warming, got %+v", report.Warming)
+	}
+}